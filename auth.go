@@ -4,6 +4,7 @@ import (
 	"crypto/ed25519"
 	"encoding/base64"
 	"errors"
+	"net/url"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -11,6 +12,11 @@ import (
 )
 
 func validateKey(key string) bool {
+	return validatePath(key) && filepath.Ext(key) != ""
+}
+
+// validatePath is validateKey of directories, which need no extension.
+func validatePath(key string) bool {
 	if len(key) > 255 {
 		return false
 	}
@@ -35,50 +41,100 @@ func validateKey(key string) bool {
 	if strings.Contains(key, ":") {
 		return false
 	}
-	if filepath.Ext(key) == "" {
-		return false
-	}
 	return true
 }
 
 func Auth(path string, public ...ed25519.PublicKey) (filePath string, err error) {
+	filePath, _, err = AuthClaims(path, nil, public...)
+	return filePath, err
+}
+
+// AuthClaims also returns the claims of query, which must be signed along
+// with the path unless there are no public keys.
+func AuthClaims(path string, query url.Values, public ...ed25519.PublicKey) (filePath string, claims url.Values, err error) {
+	claims = signedClaims(query)
 	if len(public) == 0 {
 		if false == validateKey(path) {
-			return "", errors.New("invalid path")
+			return "", nil, errors.New("invalid path")
 		}
-		return path, nil
+		return path, claims, nil
 	}
 	path = strings.Trim(path, "/")
 	for _, pk := range public {
-		switch err = auth(filepath.Dir(path), pk); err {
+		switch err = authClaims(filepath.Dir(path), claims.Encode(), pk); err {
 		case errNoAuth:
 			continue
 		case nil:
 			key := "/" + strings.SplitN(path, "/", 3)[2]
 			if false == validateKey(key) {
-				return "", errors.New("invalid path")
+				return "", nil, errors.New("invalid path")
+			}
+			return key, claims, nil
+		default:
+			break
+		}
+	}
+	return "", nil, errors.New("auth failed: " + err.Error())
+}
+
+// AuthDir authorizes path as a directory signed by its own token, for
+// requests about the directory itself like archives and listings.
+func AuthDir(path string, query url.Values, public ...ed25519.PublicKey) (dir string, claims url.Values, err error) {
+	claims = signedClaims(query)
+	if len(public) == 0 {
+		dir = "/" + strings.Trim(path, "/")
+		if false == validatePath(dir) {
+			return "", nil, errors.New("invalid path")
+		}
+		return dir, claims, nil
+	}
+	path = strings.Trim(path, "/")
+	for _, pk := range public {
+		switch err = authClaims(path, claims.Encode(), pk); err {
+		case errNoAuth:
+			continue
+		case nil:
+			dir = "/" + strings.SplitN(path, "/", 3)[2]
+			if false == validatePath(dir) {
+				return "", nil, errors.New("invalid path")
 			}
-			return key, nil
+			return dir, claims, nil
 		default:
 			break
 		}
 	}
-	return "", errors.New("auth failed: " + err.Error())
+	return "", nil, errors.New("auth failed: " + err.Error())
 }
 func genAuth(dir string, deadline time.Time, key ed25519.PrivateKey) string {
+	return genAuthClaims(dir, nil, deadline, key)
+}
+
+// genAuthClaims signs dir and claims, which are sent as the query.
+func genAuthClaims(dir string, claims url.Values, deadline time.Time, key ed25519.PrivateKey) string {
 	var token string
 	if strings.HasPrefix(dir, "/") {
 		token = strconv.FormatInt(deadline.UTC().Unix(), 10) + dir
 	} else {
 		token = strconv.FormatInt(deadline.UTC().Unix(), 10) + "/" + dir
 	}
-	sig := base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(token)))
+	sig := base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(signedToken(token, claims.Encode()))))
 	return sig + "/" + token
 }
 
 var errNoAuth = errors.New("unauthorized")
 
+func signedToken(token, claims string) string {
+	if claims == "" {
+		return token
+	}
+	return token + "?" + claims
+}
+
 func auth(dir string, public ed25519.PublicKey) error {
+	return authClaims(dir, "", public)
+}
+
+func authClaims(dir, claims string, public ed25519.PublicKey) error {
 	parts := strings.SplitN(dir, "/", 2)
 	if len(parts) != 2 {
 		return errNoAuth
@@ -99,7 +155,7 @@ func auth(dir string, public ed25519.PublicKey) error {
 	if timestamp < 0 || timestamp < time.Now().UTC().Unix() {
 		return errors.New("past timestamp")
 	}
-	if !ed25519.Verify(public, []byte(token), sig) {
+	if !ed25519.Verify(public, []byte(signedToken(token, claims)), sig) {
 		return errNoAuth
 	}
 	return nil
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"net/url"
 	"testing"
 	"time"
 )
@@ -64,3 +65,23 @@ func TestAuthPastTime(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestAuthClaims(t *testing.T) {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	claims := url.Values{"shift": {"-1500"}}
+	token := genAuthClaims("dir", claims, time.Now().Add(time.Minute), key)
+	query := url.Values{"shift": {"-1500"}, "v": {"2"}}
+	fp, got, err := AuthClaims("/"+token+"/file.vtt", query, public)
+	if err != nil || fp != "/dir/file.vtt" || got.Get("shift") != "-1500" || got.Has("v") {
+		t.Fatal(fp, got, err)
+	}
+	if _, _, err := AuthClaims("/"+token+"/file.vtt", url.Values{"shift": {"0"}}, public); err == nil {
+		t.Fatal("changed claim accepted")
+	}
+	if _, err := Auth("/"+token+"/file.vtt", public); err == nil {
+		t.Fatal("dropped claim accepted")
+	}
+}
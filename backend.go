@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Backend is an origin of objects. Download returns an empty object and nil
+// error when the object does not exist, and errNotModified when etag is not
+// empty and still matches. DownloadRange returns at most length bytes from
+// offset and the total size of the object.
+type Backend interface {
+	Download(ctx context.Context, path, etag string) (object, error)
+	DownloadRange(ctx context.Context, path, etag string, offset, length int64) (object, int64, error)
+	Test(ctx context.Context, timeout time.Duration) error
+}
+
+func newBackend(source *Source) (Backend, error) {
+	switch source.Type {
+	case "", "s3":
+		return newS3Backend(source)
+	case "dir":
+		return newDirBackend(source)
+	case "http":
+		return newHTTPBackend(source)
+	default:
+		return nil, errors.New("unknown source type " + source.Type)
+	}
+}
+
+// Origin downloads from a list of backends in order, falling back to the
+// next one when an object is missing or a backend fails.
+type Origin struct {
+	backends       []Backend
+	defaultTimeout time.Duration
+}
+
+func Connect(testSources bool, defaultTimeout time.Duration, list ...Source) (*Origin, error) {
+	var backends []Backend
+	for i := range list {
+		backend, err := newBackend(&list[i])
+		if err != nil {
+			return nil, err
+		}
+		if testSources {
+			if err := backend.Test(context.Background(), time.Second*5); err != nil {
+				return nil, err
+			}
+		}
+		backends = append(backends, backend)
+	}
+	if len(backends) == 0 {
+		panic(errors.New("no source"))
+	}
+	return &Origin{backends, defaultTimeout}, nil
+}
+
+func validateOriginKey(key string) error {
+	switch key {
+	case "", " ", "/", ".", "./", "//":
+		return errors.New("invalid key")
+	}
+	if !utf8.ValidString(key) {
+		return errors.New("non-utf8 key")
+	}
+	return nil
+}
+
+func (o *Origin) Download(ctx context.Context, key, etag string) (object, error) {
+	//TODO fetch once
+	if err := validateOriginKey(key); err != nil {
+		return object{}, err
+	}
+	return o.downloadAny(ctx, key, etag)
+}
+
+func (o *Origin) downloadAny(ctx context.Context, path, etag string) (object, error) {
+	var last error
+	for _, backend := range o.backends {
+		var obj object
+		obj, last = downloadTimeout(ctx, backend, path, etag, o.defaultTimeout)
+		if last == errNotModified || len(obj.Value) > 0 {
+			return obj, last
+		}
+		if last == errCorrupted {
+			metrics.Add("origin.corrupted", 1)
+		}
+	}
+	return object{}, last
+}
+
+func (o *Origin) DownloadRange(ctx context.Context, key, etag string, offset, length int64) (object, int64, error) {
+	if err := validateOriginKey(key); err != nil {
+		return object{}, 0, err
+	}
+	var last error
+	for _, backend := range o.backends {
+		var obj object
+		var total int64
+		obj, total, last = downloadRangeTimeout(ctx, backend, key, etag, offset, length, o.defaultTimeout)
+		if last == errNotModified || len(obj.Value) > 0 {
+			return obj, total, last
+		}
+	}
+	return object{}, 0, last
+}
+
+func downloadTimeout(ctx context.Context, backend Backend, path, etag string, timeout time.Duration) (object, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return backend.Download(ctx, path, etag)
+}
+
+func downloadRangeTimeout(ctx context.Context, backend Backend, path, etag string, offset, length int64, timeout time.Duration) (object, int64, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return backend.DownloadRange(ctx, path, etag, offset, length)
+}
+
+func httpRange(offset, length int64) string {
+	return "bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+length-1, 10)
+}
+
+// sliceObject cuts a range out of a whole object, returning its full length.
+func sliceObject(obj object, offset, length int64) (object, int64) {
+	total := int64(len(obj.Value))
+	if offset >= total {
+		return object{}, total
+	}
+	end := offset + length
+	if end > total {
+		end = total
+	}
+	obj.Value = obj.Value[offset:end]
+	return obj, total
+}
+
+// parseContentRange returns the complete length of "bytes first-last/complete".
+func parseContentRange(contentRange string) (int64, error) {
+	_, total, ok := strings.Cut(contentRange, "/")
+	if !ok || !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, errors.New("invalid content range")
+	}
+	return strconv.ParseInt(total, 10, 64)
+}
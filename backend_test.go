@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDirBackend(t *testing.T) {
+	root := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	throw(os.MkdirAll(filepath.Join(root, "dir"), 0700))
+	defer func() { _ = os.RemoveAll(root) }()
+	throw(os.WriteFile(filepath.Join(root, "dir", "file.ext"), []byte("content"), 0600))
+	backend := must(newDirBackend(&Source{Type: "dir", Root: root}))
+	throw(backend.Test(context.Background(), time.Second))
+	content := must(backend.Download(context.Background(), "/dir/file.ext", "")).Value
+	assert(string(content) == "content")
+	content = must(backend.Download(context.Background(), "/dir/missing.ext", "")).Value
+	assert(content == nil)
+	content = must(backend.Download(context.Background(), "/dir", "")).Value
+	assert(content == nil)
+}
+
+func TestHTTPBackend(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "secret" {
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch request.URL.Path {
+		case "/root/dir/file name.ext":
+			_, _ = writer.Write([]byte("content"))
+		case "/root/dir/gone.ext":
+			http.Error(writer, "gone", http.StatusGone)
+		default:
+			http.NotFound(writer, request)
+		}
+	}))
+	defer origin.Close()
+	backend := must(newHTTPBackend(&Source{
+		Type:    "http",
+		Host:    origin.URL,
+		Root:    "/root",
+		Headers: map[string]string{"Authorization": "secret"},
+	}))
+	throw(backend.Test(context.Background(), time.Second))
+	content := must(backend.Download(context.Background(), "/dir/file name.ext", "")).Value
+	assert(string(content) == "content")
+	content = must(backend.Download(context.Background(), "/dir/gone.ext", "")).Value
+	assert(content == nil)
+	content = must(backend.Download(context.Background(), "/dir/missing.ext", "")).Value
+	assert(content == nil)
+	backend.headers.Del("Authorization")
+	if _, err := backend.Download(context.Background(), "/dir/file name.ext", ""); err == nil {
+		t.Fatal("expected error on unauthorized")
+	}
+}
+
+func TestOrigin_Fallback(t *testing.T) {
+	root := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	throw(os.MkdirAll(root, 0700))
+	defer func() { _ = os.RemoveAll(root) }()
+	throw(os.WriteFile(filepath.Join(root, "file.ext"), []byte("from dir"), 0600))
+	origin := httptest.NewServer(http.NotFoundHandler())
+	defer origin.Close()
+	o := must(Connect(true, time.Second,
+		Source{Type: "http", Host: origin.URL},
+		Source{Type: "dir", Root: root},
+	))
+	content := must(o.Download(context.Background(), "/file.ext", "")).Value
+	assert(bytes.Equal(content, []byte("from dir")))
+}
@@ -1,20 +1,53 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"github.com/syndtr/goleveldb/leveldb"
 	"io"
+	"net/http"
 	"os"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// entryMeta is the origin metadata kept with a cached value. notFound
+// entries have an empty value and stand for a missing origin object.
+type entryMeta struct {
+	etag     string
+	fetched  time.Time
+	notFound bool
+	checksum uint32
+	//a pointer keeps index entries comparable
+	header *http.Header
+}
+
+func (m *entryMeta) upstream() http.Header {
+	if m.header == nil {
+		return nil
+	}
+	return *m.header
+}
+
+func metaHeader(header http.Header) *http.Header {
+	if header == nil {
+		return nil
+	}
+	return &header
+}
+
+// notFoundSize is the size a notFound entry is accounted with, so the cache
+// size bounds them along with values.
+const notFoundSize = 256
+
 type indexEntry struct {
 	lastRead  int64
 	valueSize int64
+	entryMeta
 }
 type index struct {
 	map_ sync.Map
@@ -26,6 +59,24 @@ type iCache interface {
 	Get(ctx context.Context, key string) (result, error)
 }
 
+// storer is implemented by tiers accepting values demoted from an upper tier.
+type storer interface {
+	contains(key string) bool
+	store(key string, val []byte, meta entryMeta) bool
+}
+
+// invalidator is implemented by tiers able to drop a key, so the next Get
+// fetches it again.
+type invalidator interface {
+	invalidate(key string)
+}
+
+func invalidate(c iCache, key string) {
+	if i, ok := c.(invalidator); ok {
+		i.invalidate(key)
+	}
+}
+
 func (i *index) sumSizes() int64 {
 	sum := i.size.Load()
 	assert(sum >= 0)
@@ -60,65 +111,176 @@ func (i *index) leastRead() (key string) {
 	}
 	return least.key
 }
-func (i *index) refresh(key string, size int64) {
-	pre, ok := i.map_.Swap(key, indexEntry{
-		lastRead:  time.Now().UTC().Unix(),
-		valueSize: size,
-	})
+func (i *index) touch(key string) (indexEntry, bool) {
+	value, ok := i.map_.Load(key)
+	if !ok {
+		return indexEntry{}, false
+	}
+	entry := value.(indexEntry)
+	touched := entry
+	touched.lastRead = time.Now().UTC().Unix()
+	i.map_.CompareAndSwap(key, entry, touched)
+	return entry, true
+}
+func (i *index) revalidated(key string) {
+	value, ok := i.map_.Load(key)
+	if !ok {
+		return
+	}
+	entry := value.(indexEntry)
+	revalidated := entry
+	revalidated.fetched = time.Now()
+	i.map_.CompareAndSwap(key, entry, revalidated)
+}
+func (i *index) restore(key string, entry indexEntry) {
+	pre, ok := i.map_.Swap(key, entry)
 	if ok {
-		i.size.Add(size - pre.(indexEntry).valueSize)
+		i.size.Add(entry.valueSize - pre.(indexEntry).valueSize)
 	} else {
-		i.size.Add(size)
+		i.size.Add(entry.valueSize)
+	}
+}
+
+// object is a value downloaded from the origin with its entity tag and the
+// origin headers kept with it. Total is the size of the whole object when
+// Value is a chunk of it.
+type object struct {
+	Value  []byte
+	ETag   string
+	Header http.Header
+	Total  int64
+}
+
+func (o *object) size() int64 {
+	if o.Total > 0 {
+		return o.Total
 	}
+	return int64(len(o.Value))
 }
 
-type OnMissing func(ctx context.Context, key string) ([]byte, error)
+var errNotModified = errors.New("not modified")
+
+// OnMissing downloads key, or returns errNotModified when etag is not empty
+// and still matches the origin.
+type OnMissing func(ctx context.Context, key, etag string) (object, error)
 
 func (fn OnMissing) Size() int64 { return 0 }
 
 func (fn OnMissing) Close() error { return nil }
 
 func (fn OnMissing) Get(ctx context.Context, key string) (result, error) {
-	b, err := fn(ctx, key)
-	return result{
-		false,
-		false,
-		0,
-		b,
-	}, err
+	obj, err := fn(ctx, key, "")
+	return result{Tier: "origin", Value: obj.Value, meta: entryMeta{etag: obj.ETag, fetched: time.Now(), header: metaHeader(obj.Header)}}, err
+}
+
+var errNotStored = errors.New("not stored")
+
+// storage holds the values of a cache, the cache keeps their index.
+type storage interface {
+	// get returns either the value or an open file of it, or errNotStored
+	get(key string) ([]byte, *os.File, error)
+	// put stores val with the index entry accounted for it
+	put(key string, val []byte, entry indexEntry) error
+	delete(key string) error
+	// load calls fn with each value kept from a previous run
+	load(fn func(key string, entry indexEntry)) error
+	// close closes the storage, removing values not kept across runs
+	close() error
 }
 
 type cache struct {
-	db        *leveldb.DB
-	index     index
-	max       int64
-	onMissing OnMissing
-	path      string
+	storage      storage
+	index        index
+	max          int64
+	onMissing    OnMissing
+	errorCount   atomic.Int32
+	failedAt     atomic.Int64 //unix nanoseconds, zero while healthy
+	policy       *Policy
+	revalidating sync.Map
+}
+
+// OpenCache opens a cache with the named storage backend, leveldb or files.
+func OpenCache(backend, path string, max int64, missing OnMissing) iCache {
+	switch backend {
+	case "", "leveldb":
+		return Open(path, max, missing)
+	case "files":
+		return OpenFiles(path, max, missing)
+	default:
+		panic(errors.New("unknown cache backend " + backend))
+	}
 }
 
 func Open(path string, max int64, missing OnMissing) iCache {
+	return open(max, missing, func() (storage, error) {
+		db, err := leveldb.OpenFile(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		throw(cleanDB(db))
+		return &dbStorage{db, path}, nil
+	})
+}
+
+func open(max int64, missing OnMissing, openStorage func() (storage, error)) iCache {
 	if max < 0 {
 		panic(fmt.Errorf("non positive cache max size"))
 	}
 	if max > 0 {
-		db, err := leveldb.OpenFile(path, nil)
+		s, err := openStorage()
 		if err != nil {
 			return nil
 		}
-		throw(cleanDB(db))
-		return &cache{
+		c := &cache{
 			max:       max,
-			path:      path,
 			onMissing: missing,
-			db:        db,
+			storage:   s,
 		}
+		throw(s.load(c.index.restore))
+		//the kept values may exceed a smaller max
+		_, _, err = c.clean(0)
+		throw(err)
+		return c
 	}
 	return missing
 }
 func (c *cache) Close() error {
-	err := c.db.Close()
+	return c.storage.close()
+}
+func (c *cache) setPolicy(p *Policy) {
+	c.policy = p
+	if _, encrypted := c.storage.(*encryptedStorage); p.keys != nil && !encrypted {
+		c.storage = &encryptedStorage{c.storage, p.keys}
+	}
+}
+
+type dbStorage struct {
+	db   *leveldb.DB
+	path string
+}
+
+func (d *dbStorage) get(key string) ([]byte, *os.File, error) {
+	val, err := d.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil, errNotStored
+	}
+	return val, nil, err
+}
+func (d *dbStorage) put(key string, val []byte, _ indexEntry) error {
+	return d.db.Put([]byte(key), val, nil)
+}
+func (d *dbStorage) delete(key string) error {
+	return d.db.Delete([]byte(key), nil)
+}
+
+// load finds nothing, the database is emptied when opened.
+func (d *dbStorage) load(func(key string, entry indexEntry)) error {
+	return nil
+}
+func (d *dbStorage) close() error {
+	err := d.db.Close()
 	if err == nil {
-		err = os.RemoveAll(c.path)
+		err = os.RemoveAll(d.path)
 	}
 	return err
 }
@@ -133,23 +295,72 @@ func cleanDB(db *leveldb.DB) error {
 	return iter.Error()
 }
 
-func (c *cache) fetch(ctx context.Context, key string) (val []byte, cached bool, countDeleted int, err error) {
-	val, err = c.onMissing(ctx, key)
+func (c *cache) fetch(ctx context.Context, key string) (result, error) {
+	obj, err := c.onMissing(ctx, key, "")
 	if err != nil {
-		return nil, false, 0, err
+		return result{Tier: "origin"}, err
+	}
+	return c.save(key, obj)
+}
+func (c *cache) save(key string, obj object) (result, error) {
+	meta := entryMeta{etag: obj.ETag, fetched: time.Now(), checksum: checksum(obj.Value), header: metaHeader(obj.Header)}
+	res := result{Tier: "origin", Value: obj.Value, total: obj.Total, meta: meta}
+	if len(obj.Value) == 0 {
+		if c.policy.freshness().notFoundTTL() <= 0 {
+			return res, nil
+		}
+		meta.notFound = true
+	} else if !c.policy.admits(key, obj.size()) {
+		metrics.Add("disk.rejected", 1)
+		return res, nil
 	}
-	if len(val) == 0 {
-		return nil, false, 0, nil
+	var err error
+	res.ValueCached, res.Deleted, err = c.put(key, obj.Value, meta)
+	return res, err
+}
+func (c *cache) put(key string, val []byte, meta entryMeta) (bool, int, error) {
+	if !c.healthy() {
+		return false, 0, nil
+	}
+	size := int64(len(val))
+	if sealed, ok := c.storage.(*encryptedStorage); ok {
+		size += sealed.keys.overhead()
+	}
+	if meta.notFound {
+		size = notFoundSize
 	}
-	ok, count, err := c.clean(int64(len(val)))
+	ok, count, err := c.clean(size)
 	if err != nil || !ok {
-		return val, false, count, err
+		return false, count, err
 	}
-	if c.db.Put([]byte(key), val, nil) != nil {
-		return val, false, count, err
+	entry := indexEntry{lastRead: time.Now().UTC().Unix(), valueSize: size, entryMeta: meta}
+	if err := c.storage.put(key, val, entry); err != nil {
+		c.fail(err)
+		return false, count, nil
 	}
-	c.index.refresh(key, int64(len(val)))
-	return val, true, count, nil
+	c.errorCount.Store(0)
+	c.index.restore(key, entry)
+	return true, count, nil
+}
+func (c *cache) remove(key string) error {
+	if err := c.storage.delete(key); err != nil {
+		return err
+	}
+	c.index.delete(key)
+	return nil
+}
+func (c *cache) contains(key string) bool {
+	_, ok := c.index.map_.Load(key)
+	return ok
+}
+func (c *cache) invalidate(key string) {
+	if err := c.remove(key); err != nil {
+		c.fail(err)
+	}
+}
+func (c *cache) store(key string, val []byte, meta entryMeta) bool {
+	ok, _, err := c.put(key, val, meta)
+	return ok && err == nil
 }
 func (c *cache) clean(val int64) (bool, int, error) {
 	if val >= c.max {
@@ -161,40 +372,221 @@ func (c *cache) clean(val int64) (bool, int, error) {
 		if least == "" {
 			panic(errors.New("unreachable"))
 		}
-		if err := c.db.Delete([]byte(least), nil); err != nil {
+		if err := c.remove(least); err != nil {
 			return false, n, err
 		}
-		c.index.delete(least)
 		n += 1
 	}
 	return true, n, nil
 }
 
+// result holds either Value or an open File of the value, which Close releases.
 type result struct {
-	CacheUsed   bool   `json:"cached"`
-	ValueCached bool   `json:"stored"`
-	Deleted     int    `json:"deleted"`
-	Value       []byte `json:"-"`
+	CacheUsed   bool     `json:"cached"`
+	ValueCached bool     `json:"stored"`
+	Deleted     int      `json:"deleted"`
+	Tier        string   `json:"tier"`
+	Value       []byte   `json:"-"`
+	File        *os.File `json:"-"`
+	FileSize    int64    `json:"-"`
+	//size of the whole object of a fetched chunk
+	total int64
+	meta  entryMeta
 }
 
 func (r *result) Header() string {
 	return fmt.Sprintf("%t,%t,%d", r.CacheUsed, r.ValueCached, r.Deleted)
 }
+func (r *result) Len() int64 {
+	if r.File != nil {
+		return r.FileSize
+	}
+	return int64(len(r.Value))
+}
+
+// size is the admitted size, of the whole object for chunks.
+func (r *result) size() int64 {
+	if r.total > 0 {
+		return r.total
+	}
+	return r.Len()
+}
+func (r *result) Reader() io.ReadSeeker {
+	if r.File != nil {
+		return r.File
+	}
+	return bytes.NewReader(r.Value)
+}
+func (r *result) Bytes() ([]byte, error) {
+	if r.File == nil {
+		return r.Value, nil
+	}
+	b := make([]byte, r.FileSize)
+	if _, err := r.File.ReadAt(b, 0); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+func (r *result) Close() {
+	if r.File != nil {
+		Close(r.File)
+		r.File = nil
+	}
+}
 func (c *cache) Get(ctx context.Context, key string) (result, error) {
 	if key == "" {
 		panic(errors.New("empty key"))
 	}
-	val, err := c.db.Get([]byte(key), nil)
+	if !c.healthy() {
+		return c.onMissing.Get(ctx, key)
+	}
+	val, file, err := c.storage.get(key)
 	switch err {
-	case leveldb.ErrNotFound:
-		val, cached, countDeleted, err := c.fetch(ctx, key)
-		return result{false, cached, countDeleted, val}, err
+	case errNotStored:
+		metrics.Add("disk.miss", 1)
+		return c.fetch(ctx, key)
 	case nil:
-		c.index.refresh(key, int64(len(val)))
-		return result{true, true, 0, val}, err
+		metrics.Add("disk.hit", 1)
+		c.errorCount.Store(0)
+		res := result{CacheUsed: true, ValueCached: true, Tier: "disk", Value: val, File: file}
+		if file != nil {
+			info, err := file.Stat()
+			if err != nil {
+				Close(file)
+				return result{}, err
+			}
+			res.FileSize = info.Size()
+		}
+		entry, _ := c.index.touch(key)
+		res.meta = entry.entryMeta
+		if entry.notFound {
+			res.Close()
+			if c.policy.freshness().notFoundExpired(entry.fetched) {
+				return c.fetch(ctx, key)
+			}
+			metrics.Add("disk.not-found", 1)
+			return result{CacheUsed: true, ValueCached: true, Tier: "disk", meta: entry.entryMeta}, nil
+		}
+		if c.policy.sampled() {
+			if ok, err := res.verify(entry.checksum); err != nil || !ok {
+				metrics.Add("disk.corrupted", 1)
+				res.Close()
+				if err := c.remove(key); err != nil {
+					c.fail(err)
+				}
+				return c.fetch(ctx, key)
+			}
+		}
+		switch c.policy.freshness().state(key, entry.fetched) {
+		case staleRevalidate:
+			metrics.Add("disk.stale", 1)
+			c.revalidateAsync(key, entry.etag)
+		case stale:
+			return c.revalidateStale(ctx, key, res)
+		}
+		return res, nil
 	default:
-		panic(err)
+		c.fail(err)
+		return c.onMissing.Get(ctx, key)
+	}
+}
+
+// revalidate asks the origin whether key changed since it was cached with
+// etag, and removes the entry when it did.
+func (c *cache) revalidate(ctx context.Context, key, etag string) (obj object, modified bool, err error) {
+	obj, err = c.onMissing(ctx, key, etag)
+	if err == errNotModified {
+		metrics.Add("disk.revalidated", 1)
+		c.index.revalidated(key)
+		return obj, false, nil
+	}
+	if err != nil {
+		return obj, false, err
+	}
+	return obj, true, c.remove(key)
+}
+func (c *cache) revalidateStale(ctx context.Context, key string, stale result) (result, error) {
+	obj, modified, err := c.revalidate(ctx, key, stale.meta.etag)
+	if err != nil {
+		if c.policy.freshness().staleIfError(key, stale.meta.fetched) {
+			metrics.Add("disk.stale-if-error", 1)
+			return stale, nil
+		}
+		stale.Close()
+		return result{}, err
+	}
+	if !modified {
+		return stale, nil
+	}
+	stale.Close()
+	return c.save(key, obj)
+}
+func (c *cache) revalidateAsync(key, etag string) {
+	if _, running := c.revalidating.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	go func() {
+		defer c.revalidating.Delete(key)
+		obj, modified, err := c.revalidate(context.Background(), key, etag)
+		if err == nil && modified {
+			_, _ = c.save(key, obj)
+		}
+	}()
+}
+
+// maxStorageErrors is how many errors in a row take a storage out of service,
+// I/O errors take it out at once. It is probed again every probeInterval.
+const (
+	maxStorageErrors = 5
+	probeInterval    = time.Minute
+)
+
+// fail counts a storage error, and takes the storage out of service when it
+// looks broken. Its keys are then served directly from the origin.
+func (c *cache) fail(err error) {
+	if c.errorCount.Add(1) < maxStorageErrors && !errors.Is(err, syscall.EIO) {
+		return
+	}
+	if c.failedAt.CompareAndSwap(0, time.Now().UnixNano()) {
+		metrics.Add("disk.failed", 1)
+		fmt.Println("cache storage failed:", err)
+	}
+}
+
+// healthy reports whether the storage is in service, probing a failed one
+// again once probeInterval passed.
+func (c *cache) healthy() bool {
+	failedAt := c.failedAt.Load()
+	if failedAt == 0 {
+		return true
+	}
+	if time.Since(time.Unix(0, failedAt)) < probeInterval || !c.failedAt.CompareAndSwap(failedAt, time.Now().UnixNano()) {
+		return false
+	}
+	if err := c.probe(); err != nil {
+		return false
+	}
+	c.errorCount.Store(0)
+	c.failedAt.Store(0)
+	metrics.Add("disk.recovered", 1)
+	fmt.Println("cache storage recovered")
+	return true
+}
+
+// probe writes, reads and deletes a key no request can ask for.
+func (c *cache) probe() error {
+	const key = ":probe"
+	if err := c.storage.put(key, []byte(key), indexEntry{}); err != nil {
+		return err
+	}
+	_, file, err := c.storage.get(key)
+	if err != nil {
+		return err
+	}
+	if file != nil {
+		Close(file)
 	}
+	return c.storage.delete(key)
 }
 func (c *cache) Size() int64 {
 	return c.index.sumSizes()
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -12,20 +13,34 @@ import (
 	"time"
 )
 
+var cacheBackends = []string{"leveldb", "files"}
+
+func forEachBackend(t *testing.T, test func(t *testing.T, backend string)) {
+	for _, backend := range cacheBackends {
+		t.Run(backend, func(t *testing.T) { test(t, backend) })
+	}
+}
+func value(result result) []byte {
+	defer result.Close()
+	return must(result.Bytes())
+}
 func TestLargeFile(t *testing.T) {
+	forEachBackend(t, testLargeFile)
+}
+func testLargeFile(t *testing.T, backend string) {
 	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().Unix(), 10))
-	cache := Open(dbPath, 1e+10, func(ctx context.Context, key string) ([]byte, error) {
-		return make([]byte, 1e+9), nil
+	cache := OpenCache(backend, dbPath, 1e+10, func(ctx context.Context, key, etag string) (object, error) {
+		return object{Value: make([]byte, 1e+9)}, nil
 	})
-	defer func() { _ = cache.Close() }()
+	defer func() { _ = cache.Close(); _ = os.RemoveAll(dbPath) }()
 	result := must(cache.Get(context.Background(), "key"))
 	assert(!result.CacheUsed)
 	assert(result.ValueCached)
-	assert(len(result.Value) == 1e+9)
+	assert(len(value(result)) == 1e+9)
 	result = must(cache.Get(context.Background(), "key"))
 	assert(result.CacheUsed)
 	assert(result.ValueCached)
-	assert(len(result.Value) == 1e+9)
+	assert(len(value(result)) == 1e+9)
 
 }
 func insert(c iCache, key, size int, CacheUsed, ValueCached bool, Deleted int) {
@@ -33,15 +48,18 @@ func insert(c iCache, key, size int, CacheUsed, ValueCached bool, Deleted int) {
 	assert(result.CacheUsed == CacheUsed)
 	assert(result.ValueCached == ValueCached)
 	assert(result.Deleted == Deleted)
-	assert(bytes.Equal(make([]byte, size), result.Value))
+	assert(bytes.Equal(make([]byte, size), value(result)))
 }
 func TestCache_LRU(t *testing.T) {
+	forEachBackend(t, testCache_LRU)
+}
+func testCache_LRU(t *testing.T, backend string) {
 	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().Unix(), 10))
-	cache := Open(dbPath, 1000, func(ctx context.Context, key string) ([]byte, error) {
+	cache := OpenCache(backend, dbPath, 1000, func(ctx context.Context, key, etag string) (object, error) {
 		size := must(strconv.Atoi(strings.Split(key, ":")[1]))
-		return make([]byte, size), nil
+		return object{Value: make([]byte, size)}, nil
 	})
-	defer func() { _ = cache.Close() }()
+	defer func() { _ = cache.Close(); _ = os.RemoveAll(dbPath) }()
 	insert(cache, 1, 1000, false, false, 0)
 	assert(cache.Size() == 0)
 	insert(cache, 2, 999, false, true, 0)
@@ -64,30 +82,36 @@ func TestCache_LRU(t *testing.T) {
 	assert(cache.Size() == 2*100)
 }
 func TestCache_Size(t *testing.T) {
+	forEachBackend(t, testCache_Size)
+}
+func testCache_Size(t *testing.T, backend string) {
 	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().Unix(), 10))
-	cache := Open(dbPath, 10000, func(ctx context.Context, key string) ([]byte, error) {
-		return make([]byte, 100), nil
+	cache := OpenCache(backend, dbPath, 10000, func(ctx context.Context, key, etag string) (object, error) {
+		return object{Value: make([]byte, 100)}, nil
 	})
-	defer func() { _ = cache.Close() }()
+	defer func() { _ = cache.Close(); _ = os.RemoveAll(dbPath) }()
 	for i := range make([]struct{}, 111) {
 		result := must(cache.Get(context.Background(), strconv.Itoa(i)))
 		assert(!result.CacheUsed)
 		assert(result.ValueCached)
 		assert(result.Deleted == i/(101-1))
-		assert(bytes.Equal(make([]byte, 100), result.Value))
+		assert(bytes.Equal(make([]byte, 100), value(result)))
 	}
 	assert(cache.Size() == 100*100)
 }
 
 func TestCache_Get(t *testing.T) {
+	forEachBackend(t, testCache_Get)
+}
+func testCache_Get(t *testing.T, backend string) {
 	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().Unix(), 10))
-	cache := Open(dbPath, 10000, func(ctx context.Context, key string) ([]byte, error) {
-		return []byte("bar"), nil
+	cache := OpenCache(backend, dbPath, 10000, func(ctx context.Context, key, etag string) (object, error) {
+		return object{Value: []byte("bar")}, nil
 	})
-	defer func() { _ = cache.Close() }()
+	defer func() { _ = cache.Close(); _ = os.RemoveAll(dbPath) }()
 	result := must(cache.Get(context.Background(), "foo"))
-	if string(result.Value) != "bar" {
-		t.Fatalf("expected bar get %s", string(result.Value))
+	if v := string(value(result)); v != "bar" {
+		t.Fatalf("expected bar get %s", v)
 	}
 	if !result.ValueCached {
 		t.Fatal("value not cached")
@@ -99,8 +123,8 @@ func TestCache_Get(t *testing.T) {
 		t.Fatal("Delete is not zero")
 	}
 	result = must(cache.Get(context.Background(), "foo"))
-	if string(result.Value) != "bar" {
-		t.Fatalf("expected bar get %s", string(result.Value))
+	if v := string(value(result)); v != "bar" {
+		t.Fatalf("expected bar get %s", v)
 	}
 	if !result.ValueCached {
 		t.Fatal("value not cached")
@@ -112,3 +136,27 @@ func TestCache_Get(t *testing.T) {
 		t.Fatal("Delete is not zero")
 	}
 }
+
+func TestFileStorage_Persist(t *testing.T) {
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	defer func() { _ = os.RemoveAll(dbPath) }()
+	fetches := 0
+	missing := func(ctx context.Context, key, etag string) (object, error) {
+		fetches++
+		return object{Value: []byte("film"), ETag: `"1"`, Header: http.Header{"Content-Type": {"video/mp4"}}}, nil
+	}
+	cache := OpenCache("files", dbPath, 1000, missing)
+	must(cache.Get(context.Background(), "/film.mp4"))
+	throw(cache.Close())
+	orphan := filepath.Join(dbPath, "objects", "orphan")
+	throw(os.WriteFile(orphan, []byte("orphan"), 0600))
+
+	cache = OpenCache("files", dbPath, 1000, missing)
+	defer func() { _ = cache.Close() }()
+	assert(cache.Size() == 4)
+	result := must(cache.Get(context.Background(), "/film.mp4"))
+	assert(result.CacheUsed && fetches == 1 && string(value(result)) == "film")
+	assert(result.meta.etag == `"1"` && result.meta.upstream().Get("Content-Type") == "video/mp4")
+	_, err := os.Stat(orphan)
+	assert(os.IsNotExist(err))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"strings"
+)
+
+var errCorrupted = errors.New("checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum is stored with every cached value and verified on read.
+func checksum(val []byte) uint32 {
+	return crc32.Checksum(val, castagnoli)
+}
+
+// verifyDigest compares content with a base64 digest of the named algorithm.
+// Composite checksums of multipart objects ("digest-parts") are skipped.
+func verifyDigest(algorithm, expected string, content []byte) error {
+	if expected == "" || strings.Contains(expected, "-") {
+		return nil
+	}
+	var h hash.Hash
+	switch algorithm {
+	case "crc32c":
+		h = crc32.New(castagnoli)
+	case "crc32":
+		h = crc32.NewIEEE()
+	case "sha256":
+		h = sha256.New()
+	case "sha1":
+		h = sha1.New()
+	case "md5":
+		h = md5.New()
+	default:
+		return errors.New("unknown digest " + algorithm)
+	}
+	_, _ = h.Write(content)
+	if base64.StdEncoding.EncodeToString(h.Sum(nil)) != expected {
+		return errCorrupted
+	}
+	return nil
+}
+
+// verifyETag compares content with an ETag holding its hex MD5, as S3 sets
+// for objects uploaded in one part without KMS encryption.
+func verifyETag(etag string, content []byte) error {
+	etag = strings.Trim(etag, `"`)
+	if len(etag) != md5.Size*2 {
+		return nil
+	}
+	sum := md5.Sum(content)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), etag) {
+		return errCorrupted
+	}
+	return nil
+}
+
+// verify checks the value of r against sum.
+func (r *result) verify(sum uint32) (bool, error) {
+	if r.File == nil {
+		return checksum(r.Value) == sum, nil
+	}
+	h := crc32.New(castagnoli)
+	if _, err := io.Copy(h, io.NewSectionReader(r.File, 0, r.FileSize)); err != nil {
+		return false, err
+	}
+	return h.Sum32() == sum, nil
+}
+
+// sampled reports whether a cache hit is verified, for a fraction of hits.
+func (p *Policy) sampled() bool {
+	if p == nil || p.Verify <= 0 {
+		return false
+	}
+	return p.Verify >= 1 || rand.Float64() < p.Verify
+}
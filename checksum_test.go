@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyDigest(t *testing.T) {
+	content := []byte("content")
+	sha := sha256.Sum256(content)
+	assert(verifyDigest("sha256", base64.StdEncoding.EncodeToString(sha[:]), content) == nil)
+	assert(verifyDigest("sha256", base64.StdEncoding.EncodeToString(sha[:]), []byte("other")) == errCorrupted)
+	assert(verifyDigest("crc32c", "AAAAAA==-2", content) == nil)
+	assert(verifyDigest("md5", "", content) == nil)
+	sum := md5.Sum(content)
+	assert(verifyETag(`"`+hex.EncodeToString(sum[:])+`"`, content) == nil)
+	assert(verifyETag(`"`+hex.EncodeToString(sum[:])+`"`, []byte("other")) == errCorrupted)
+	assert(verifyETag(`"abc-2"`, content) == nil)
+}
+
+func TestCache_Corrupted(t *testing.T) {
+	forEachBackend(t, testCache_Corrupted)
+}
+func testCache_Corrupted(t *testing.T, backend string) {
+	fetches := 0
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	c := OpenCache(backend, dbPath, 1000, func(ctx context.Context, key, etag string) (object, error) {
+		fetches++
+		return object{Value: []byte("content")}, nil
+	}).(*cache)
+	defer func() { _ = c.Close(); _ = os.RemoveAll(dbPath) }()
+	c.setPolicy(&Policy{Verify: 1})
+	must(c.Get(context.Background(), "/key"))
+	throw(c.storage.put("/key", []byte("CONTENT"), indexEntry{}))
+	result := must(c.Get(context.Background(), "/key"))
+	assert(!result.CacheUsed && string(value(result)) == "content" && fetches == 2)
+	result = must(c.Get(context.Background(), "/key"))
+	assert(result.CacheUsed && string(value(result)) == "content" && fetches == 2)
+}
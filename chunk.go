@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// chunked caches objects as fixed size chunks under "key:index", each value
+// prefixed by the total object size. Keys never contain ':' (see validateKey).
+type chunked struct {
+	cache iCache
+	size  int64
+}
+
+type rangeDownloader func(ctx context.Context, key, etag string, offset, length int64) (object, int64, error)
+
+func chunkKey(key string, index int64) string {
+	return key + ":" + strconv.FormatInt(index, 10)
+}
+
+// fetcher returns the OnMissing of the chunk cache, downloading one chunk.
+func (c *chunked) fetcher(download rangeDownloader) OnMissing {
+	return func(ctx context.Context, key, etag string) (object, error) {
+		sep := strings.LastIndexByte(key, ':')
+		if sep < 0 {
+			return object{}, errors.New("not a chunk key")
+		}
+		index, err := strconv.ParseInt(key[sep+1:], 10, 64)
+		if err != nil {
+			return object{}, err
+		}
+		obj, total, err := download(ctx, key[:sep], etag, index*c.size, c.size)
+		if err != nil || len(obj.Value) == 0 {
+			return obj, err
+		}
+		val := make([]byte, 8+len(obj.Value))
+		binary.BigEndian.PutUint64(val, uint64(total))
+		copy(val[8:], obj.Value)
+		return object{Value: val, ETag: obj.ETag, Header: obj.Header, Total: total}, nil
+	}
+}
+
+func (c *chunked) chunk(ctx context.Context, key string, index int64) (res result, total int64, data []byte, err error) {
+	res, err = c.cache.Get(ctx, chunkKey(key, index))
+	if err != nil {
+		return res, 0, nil, err
+	}
+	val, err := res.Bytes()
+	res.Close()
+	if err != nil {
+		return res, 0, nil, err
+	}
+	if len(val) == 0 {
+		return res, 0, nil, nil
+	}
+	if len(val) < 8 {
+		return res, 0, nil, errors.New("corrupted chunk")
+	}
+	return res, int64(binary.BigEndian.Uint64(val)), val[8:], nil
+}
+
+var errChunkChanged = errors.New("object changed while read by chunks")
+
+// consistent fetches chunk index of key from the same object version as the
+// first chunk, with its etag and total. A mismatching chunk is fetched again,
+// and when it still mismatches the first chunk is the stale one, which is
+// dropped so the next request starts over from the new version.
+func (c *chunked) consistent(ctx context.Context, key string, index int64, etag string, total int64) ([]byte, error) {
+	for retry := false; ; retry = true {
+		res, size, data, err := c.chunk(ctx, key, index)
+		if err != nil || data == nil || (size == total && res.meta.etag == etag) {
+			return data, err
+		}
+		if retry {
+			invalidate(c.cache, chunkKey(key, 0))
+			return nil, errChunkChanged
+		}
+		invalidate(c.cache, chunkKey(key, index))
+	}
+}
+
+// open fetches the first chunk of key, which is nil when key does not exist.
+func (c *chunked) open(ctx context.Context, key string) (result, *chunkReader, error) {
+	res, total, data, err := c.chunk(ctx, key, 0)
+	if err != nil || data == nil {
+		return res, nil, err
+	}
+	return res, &chunkReader{
+		ctx:     ctx,
+		chunks:  c,
+		key:     key,
+		etag:    res.meta.etag,
+		size:    total,
+		current: data,
+	}, nil
+}
+
+var _ io.ReadSeeker = (*chunkReader)(nil)
+
+// chunkReader reads an object chunk by chunk, fetching only the chunks read,
+// all of the version of the first chunk.
+type chunkReader struct {
+	ctx     context.Context
+	chunks  *chunked
+	key     string
+	etag    string
+	size    int64
+	offset  int64
+	index   int64
+	current []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	index := r.offset / r.chunks.size
+	if index != r.index || r.current == nil {
+		data, err := r.chunks.consistent(r.ctx, r.key, index, r.etag, r.size)
+		if err != nil {
+			return 0, err
+		}
+		if data == nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.index, r.current = index, data
+	}
+	start := r.offset - index*r.chunks.size
+	if start >= int64(len(r.current)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.current[start:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
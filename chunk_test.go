@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestChunked_Range(t *testing.T) {
+	root := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	throw(os.MkdirAll(filepath.Join(root, "src"), 0700))
+	defer func() { _ = os.RemoveAll(root) }()
+	content := make([]byte, 1000)
+	must(rand.Read(content))
+	throw(os.WriteFile(filepath.Join(root, "src", "film.mp4"), content, 0600))
+	origin := must(Connect(false, time.Second, Source{Type: "dir", Root: filepath.Join(root, "src")}))
+	chunks := &chunked{size: 100}
+	disk := Open(filepath.Join(root, "db"), 10000, chunks.fetcher(origin.DownloadRange))
+	defer func() { _ = disk.Close() }()
+	chunks.cache = disk
+	server := &Server{cache: disk, chunks: chunks}
+
+	request := httptest.NewRequest(http.MethodGet, "/film.mp4", nil)
+	request.Header.Set("Range", "bytes=450-549")
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	assert(recorder.Code == http.StatusPartialContent)
+	assert(bytes.Equal(recorder.Body.Bytes(), content[450:550]))
+	assert(recorder.Header().Get("Content-Range") == "bytes 450-549/1000")
+	for index, cached := range []bool{true, false, false, false, true, true, false} {
+		assert(disk.(*cache).contains(chunkKey("/film.mp4", int64(index))) == cached)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/film.mp4", nil))
+	assert(recorder.Code == http.StatusOK)
+	assert(bytes.Equal(recorder.Body.Bytes(), content))
+	assert(disk.Size() == 1000+10*8)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/missing.mp4", nil))
+	assert(recorder.Code == http.StatusNotFound)
+}
+
+func TestHTTPBackend_DownloadRange(t *testing.T) {
+	content := []byte("0123456789")
+	for _, ranges := range []bool{true, false} {
+		ranges := ranges
+		origin := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if ranges {
+				http.ServeContent(writer, request, "", time.Time{}, bytes.NewReader(content))
+				return
+			}
+			_, _ = writer.Write(content)
+		}))
+		backend := must(newHTTPBackend(&Source{Type: "http", Host: origin.URL}))
+		part, total, err := backend.DownloadRange(context.Background(), "/file", "", 4, 3)
+		throw(err)
+		assert(string(part.Value) == "456" && total == 10)
+		part, total, err = backend.DownloadRange(context.Background(), "/file", "", 8, 5)
+		throw(err)
+		assert(string(part.Value) == "89" && total == 10)
+		origin.Close()
+	}
+}
+
+func TestChunkReader_Seek(t *testing.T) {
+	content := []byte("abcdefghij")
+	chunks := &chunked{size: 3}
+	chunks.cache = chunks.fetcher(func(ctx context.Context, key, etag string, offset, length int64) (object, int64, error) {
+		end := offset + length
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		return object{Value: content[offset:end]}, int64(len(content)), nil
+	})
+	_, reader, err := chunks.open(context.Background(), "/key")
+	throw(err)
+	must(reader.Seek(-4, io.SeekEnd))
+	rest := must(io.ReadAll(reader))
+	assert(string(rest) == "ghij")
+	must(reader.Seek(2, io.SeekStart))
+	buf := make([]byte, 5)
+	must(io.ReadFull(reader, buf))
+	assert(string(buf) == "cdefg")
+}
+
+func TestChunkReader_Changed(t *testing.T) {
+	content, etag := []byte("abcdefghij"), `"1"`
+	chunks := &chunked{size: 3}
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	disk := Open(dbPath, 1000, chunks.fetcher(func(ctx context.Context, key, _ string, offset, length int64) (object, int64, error) {
+		end := offset + length
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		return object{Value: content[offset:end], ETag: etag}, int64(len(content)), nil
+	}))
+	defer func() { _ = disk.Close() }()
+	chunks.cache = disk
+	read := func() ([]byte, error) {
+		_, reader, err := chunks.open(context.Background(), "/key")
+		throw(err)
+		return io.ReadAll(reader)
+	}
+	assert(string(must(read())) == "abcdefghij")
+
+	content, etag = []byte("ABCDEFGHIJKL"), `"2"`
+	invalidate(disk, chunkKey("/key", 2))
+	_, err := read()
+	assert(err == errChunkChanged)
+	assert(!disk.(*cache).contains(chunkKey("/key", 0)))
+	assert(string(must(read())) == "ABCDEFGHIJKL")
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+)
+
+const claimShift = "shift"
+
+// claimNames are the query parameters covered by the URL signature. Other
+// parameters, e.g. cache busters, are ignored.
+var claimNames = []string{claimShift, claimWidth, claimHeight, claimFit, claimFormat, claimQuality, claimFilename, claimDisposition, claimBitrate}
+
+func signedClaims(query url.Values) url.Values {
+	claims := url.Values{}
+	for _, name := range claimNames {
+		if v, ok := query[name]; ok {
+			claims[name] = v
+		}
+	}
+	return claims
+}
+
+// claimInt returns 0 for an absent claim.
+func claimInt(claims url.Values, name string) (int64, error) {
+	v := claims.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Compression gzips responses of matching mime types. Range requests are
+// always served the identity encoding so byte offsets keep their meaning.
+type Compression struct {
+	//mime types, a type ending with / matches the whole family (text/)
+	Types []string `yaml:"types"`
+	//bytes
+	MinSize int64 `yaml:"min-size"`
+	MaxSize int64 `yaml:"max-size"`
+	//store compressed variants in the cache, otherwise they are streamed
+	Cache bool `yaml:"cache"`
+}
+
+const (
+	gzipSuffix         = ":gzip"
+	defaultCompressMax = 16 << 20
+)
+
+func (c *Compression) enabled() *Compression {
+	if len(c.Types) == 0 {
+		return nil
+	}
+	return c
+}
+
+func (c *Compression) compressible(mimeType string) bool {
+	if c == nil {
+		return false
+	}
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	for _, t := range c.Types {
+		if t == mimeType || strings.HasSuffix(t, "/") && strings.HasPrefix(mimeType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Compression) sized(size int64) bool {
+	max := c.MaxSize
+	if max == 0 {
+		max = defaultCompressMax
+	}
+	return size >= c.MinSize && size <= max
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func gzipAll(r io.Reader) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compress serves the gzip variant of content when it is worth compressing,
+// from the cache when variants are cached and streamed otherwise. It reports
+// false when content is left to be served as is.
+func (s *Server) compress(writer http.ResponseWriter, request *http.Request, key string, content io.ReadSeeker) bool {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	if !s.compression.sized(size) {
+		return false
+	}
+	if !s.compression.Cache {
+		metrics.Add("compression.gzip", 1)
+		stream := &streamWriter{ResponseWriter: writer}
+		stream.Header().Set("Content-Encoding", "gzip")
+		w := gzip.NewWriter(stream)
+		if _, err := io.Copy(w, content); err != nil {
+			stream.abort(err)
+			return true
+		}
+		if err := w.Close(); err != nil {
+			stream.abort(err)
+		}
+		return true
+	}
+	res, err := s.cache.Get(request.Context(), key+gzipSuffix)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	defer res.Close()
+	if res.Len() == 0 {
+		return false
+	}
+	metrics.Add("compression.gzip", 1)
+	writer.Header().Set("Content-Encoding", "gzip")
+	//ServeContent omits the length of encoded content
+	writer.Header().Set("Content-Length", strconv.FormatInt(res.Len(), 10))
+	http.ServeContent(writer, request, "", time.Time{}, res.Reader())
+	return true
+}
+
+// gzipFetcher builds the compressed variants requested from the cache out of
+// the identity content of the same site.
+func (s *Server) gzipFetcher(next OnMissing) OnMissing {
+	return func(ctx context.Context, key, etag string) (object, error) {
+		original, ok := strings.CutSuffix(key, gzipSuffix)
+		if !ok {
+			return next(ctx, key, etag)
+		}
+		res, content, err := s.content(ctx, ctx, original)
+		if err != nil || content == nil {
+			return object{}, err
+		}
+		defer res.Close()
+		if etag != "" && etag == res.meta.etag {
+			return object{ETag: etag}, errNotModified
+		}
+		value, err := gzipAll(content)
+		if err != nil {
+			return object{}, err
+		}
+		return object{Value: value, ETag: res.meta.etag}, nil
+	}
+}
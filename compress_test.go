@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	assert(acceptsGzip("gzip, deflate, br"))
+	assert(acceptsGzip("br;q=1.0, GZIP;q=0.5"))
+	assert(acceptsGzip("*"))
+	assert(!acceptsGzip("gzip;q=0"))
+	assert(!acceptsGzip("identity"))
+	assert(!acceptsGzip(""))
+}
+
+func TestServer_Compression(t *testing.T) {
+	body := strings.Repeat(`{"a":1}`, 100)
+	hits := 0
+	s := &Server{compression: &Compression{Types: []string{"application/json"}, MinSize: 100, Cache: true}}
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	s.cache = Open(dbPath, 1e+6, s.gzipFetcher(func(ctx context.Context, key, etag string) (object, error) {
+		hits++
+		return object{Value: []byte(body)}, nil
+	}))
+	defer func() { _ = s.cache.Close() }()
+	get := func(header http.Header) *http.Response {
+		request := httptest.NewRequest(http.MethodGet, "/a.json", nil)
+		for k, v := range header {
+			request.Header[k] = v
+		}
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, request)
+		return recorder.Result()
+	}
+	for i := 0; i < 2; i++ {
+		response := get(http.Header{"Accept-Encoding": {"gzip"}})
+		assert(response.Header.Get("Content-Encoding") == "gzip")
+		assert(response.Header.Get("Vary") == "Accept-Encoding")
+		compressed := must(io.ReadAll(response.Body))
+		assert(response.Header.Get("Content-Length") == strconv.Itoa(len(compressed)))
+		assert(string(must(io.ReadAll(must(gzip.NewReader(bytes.NewReader(compressed)))))) == body)
+	}
+	assert(hits == 1)
+	response := get(http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-6"}})
+	assert(response.StatusCode == http.StatusPartialContent)
+	assert(response.Header.Get("Content-Encoding") == "")
+	assert(string(must(io.ReadAll(response.Body))) == `{"a":1}`)
+	response = get(nil)
+	assert(response.Header.Get("Content-Encoding") == "")
+	assert(string(must(io.ReadAll(response.Body))) == body)
+}
+
+func TestServer_CompressionStreamed(t *testing.T) {
+	body := strings.Repeat(`{"a":1}`, 100)
+	s := &Server{compression: &Compression{Types: []string{"application/json"}}}
+	s.cache = OnMissing(func(ctx context.Context, key, etag string) (object, error) {
+		assert(key == "/a.json")
+		return object{Value: []byte(body)}, nil
+	})
+	request := httptest.NewRequest(http.MethodGet, "/a.json", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, request)
+	response := recorder.Result()
+	assert(response.StatusCode == http.StatusOK && response.Header.Get("Content-Encoding") == "gzip")
+	assert(response.Header.Get("Content-Length") == "")
+	assert(string(must(io.ReadAll(must(gzip.NewReader(response.Body))))) == body)
+}
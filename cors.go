@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS allows cross origin requests from listed origins, the matched origin
+// is reflected. Without origins the legacy headers.cors value is sent as is.
+type CORS struct {
+	//like https://example.com, https://*.example.com for subdomains or *
+	Origins []string `yaml:"origins"`
+	//request headers allowed by preflights besides the safelisted ones
+	Headers []string `yaml:"headers"`
+	//response headers readable by scripts
+	Expose []string      `yaml:"expose"`
+	MaxAge time.Duration `yaml:"max-age"`
+}
+
+var (
+	corsSafelisted = []string{"Accept", "Accept-Language", "Content-Language", "Content-Type", "Range"}
+	corsExpose     = []string{"Content-Range", "Content-Length", "Accept-Ranges", "X-Cache"}
+)
+
+type corsPolicy struct {
+	origins []string
+	headers map[string]bool
+	expose  string
+	maxAge  string
+	legacy  string
+}
+
+func newCORS(config CORS, legacy string) *corsPolicy {
+	c := &corsPolicy{legacy: legacy, headers: map[string]bool{}}
+	for _, origin := range config.Origins {
+		c.origins = append(c.origins, strings.ToLower(strings.TrimSuffix(origin, "/")))
+	}
+	for _, name := range append(corsSafelisted, config.Headers...) {
+		c.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	expose := config.Expose
+	if len(expose) == 0 {
+		expose = corsExpose
+	}
+	c.expose = strings.Join(expose, ", ")
+	if config.MaxAge > 0 {
+		c.maxAge = strconv.FormatInt(int64(config.MaxAge/time.Second), 10)
+	}
+	return c
+}
+
+func (c *corsPolicy) allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		//https://*.example.com matches any depth of subdomains
+		if scheme, domain, ok := strings.Cut(allowed, "://*."); ok &&
+			strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle sets the CORS headers of a response and answers OPTIONS, returning
+// true when the response is complete.
+func (c *corsPolicy) handle(writer http.ResponseWriter, request *http.Request) bool {
+	header := writer.Header()
+	if c == nil || len(c.origins) == 0 {
+		header.Set("Access-Control-Allow-Methods", "OPTIONS, GET")
+		header.Set("Access-Control-Allow-Origin", c.legacyOrigin())
+		if request.Method == http.MethodOptions {
+			writer.WriteHeader(http.StatusNoContent)
+			return true
+		}
+		return false
+	}
+	header.Add("Vary", "Origin")
+	origin := request.Header.Get("Origin")
+	allowed := origin != "" && c.allowed(origin)
+	if allowed {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if request.Method != http.MethodOptions {
+		if allowed {
+			header.Set("Access-Control-Expose-Headers", c.expose)
+		}
+		return false
+	}
+	method := request.Header.Get("Access-Control-Request-Method")
+	if method == "" {
+		header.Set("Allow", "OPTIONS, GET")
+		writer.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	if !allowed {
+		metrics.Add("cors.rejected", 1)
+		http.Error(writer, "origin not allowed", http.StatusForbidden)
+		return true
+	}
+	if method != http.MethodGet {
+		metrics.Add("cors.rejected", 1)
+		http.Error(writer, "method not allowed", http.StatusForbidden)
+		return true
+	}
+	requested := request.Header.Get("Access-Control-Request-Headers")
+	for _, name := range strings.Split(requested, ",") {
+		if name = strings.TrimSpace(name); name != "" && !c.headers[http.CanonicalHeaderKey(name)] {
+			metrics.Add("cors.rejected", 1)
+			http.Error(writer, "header "+name+" not allowed", http.StatusForbidden)
+			return true
+		}
+	}
+	header.Set("Access-Control-Allow-Methods", "GET")
+	if requested != "" {
+		header.Set("Access-Control-Allow-Headers", requested)
+	}
+	if c.maxAge != "" {
+		header.Set("Access-Control-Max-Age", c.maxAge)
+	}
+	writer.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (c *corsPolicy) legacyOrigin() string {
+	if c == nil {
+		return ""
+	}
+	return c.legacy
+}
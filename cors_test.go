@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	c := newCORS(CORS{Origins: []string{"https://player.example", "https://*.brand.example"}, Headers: []string{"x-session"}, MaxAge: time.Hour}, "")
+	assert(c.allowed("https://player.example"))
+	assert(c.allowed("https://a.b.brand.example"))
+	assert(!c.allowed("https://brand.example"))
+	assert(!c.allowed("http://a.brand.example"))
+	assert(!c.allowed("https://evilbrand.example"))
+	request := func(method, origin string, header ...string) (*httptest.ResponseRecorder, bool) {
+		r := httptest.NewRequest(method, "/a.mp4", nil)
+		r.Header.Set("Origin", origin)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		return w, c.handle(w, r)
+	}
+	w, done := request(http.MethodGet, "https://a.brand.example")
+	assert(!done && w.Header().Get("Access-Control-Allow-Origin") == "https://a.brand.example")
+	assert(w.Header().Get("Vary") == "Origin" && w.Header().Get("Access-Control-Expose-Headers") == "Content-Range, Content-Length, Accept-Ranges, X-Cache")
+	w, done = request(http.MethodGet, "https://other.example")
+	assert(!done && w.Header().Get("Access-Control-Allow-Origin") == "")
+	w, done = request(http.MethodOptions, "https://player.example", "Access-Control-Request-Method", "GET", "Access-Control-Request-Headers", "range, X-Session")
+	assert(done && w.Code == http.StatusNoContent)
+	assert(w.Header().Get("Access-Control-Allow-Headers") == "range, X-Session" && w.Header().Get("Access-Control-Max-Age") == "3600")
+	w, _ = request(http.MethodOptions, "https://player.example", "Access-Control-Request-Method", "PUT")
+	assert(w.Code == http.StatusForbidden)
+	w, _ = request(http.MethodOptions, "https://player.example", "Access-Control-Request-Method", "GET", "Access-Control-Request-Headers", "authorization")
+	assert(w.Code == http.StatusForbidden)
+	w, _ = request(http.MethodOptions, "https://other.example", "Access-Control-Request-Method", "GET")
+	assert(w.Code == http.StatusForbidden)
+	legacy := newCORS(CORS{}, "*")
+	w = httptest.NewRecorder()
+	assert(legacy.handle(w, httptest.NewRequest(http.MethodOptions, "/a.mp4", nil)))
+	assert(w.Code == http.StatusNoContent && w.Header().Get("Access-Control-Allow-Origin") == "*")
+}
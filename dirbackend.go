@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ Backend = (*dirBackend)(nil)
+
+// dirBackend serves objects from a local directory such as a mounted archive.
+type dirBackend struct {
+	root string
+}
+
+func newDirBackend(source *Source) (*dirBackend, error) {
+	if source.Root == "" {
+		return nil, errors.New("dir source without root")
+	}
+	root, err := filepath.Abs(source.Root)
+	if err != nil {
+		return nil, err
+	}
+	return &dirBackend{root}, nil
+}
+
+func (d *dirBackend) file(path string) (string, error) {
+	name := filepath.Join(d.root, filepath.FromSlash(path))
+	if name != d.root && !strings.HasPrefix(name, d.root+string(filepath.Separator)) {
+		return "", errors.New("path outside root")
+	}
+	return name, nil
+}
+
+func (d *dirBackend) open(path string) (*os.File, fs.FileInfo, error) {
+	name, err := d.file(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		Close(file)
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		Close(file)
+		return nil, nil, nil
+	}
+	return file, info, nil
+}
+
+// fileETag derives an entity tag from the modification time and size.
+func fileETag(info fs.FileInfo) string {
+	return `"` + strconv.FormatInt(info.ModTime().UnixNano(), 16) + "-" + strconv.FormatInt(info.Size(), 16) + `"`
+}
+
+func (d *dirBackend) Download(ctx context.Context, path, etag string) (object, error) {
+	obj, _, err := d.DownloadRange(ctx, path, etag, 0, -1)
+	return obj, err
+}
+
+// DownloadRange reads the whole file when length is negative.
+func (d *dirBackend) DownloadRange(ctx context.Context, path, etag string, offset, length int64) (object, int64, error) {
+	file, info, err := d.open(path)
+	if err != nil || file == nil {
+		return object{}, 0, err
+	}
+	defer Close(file)
+	if err := ctx.Err(); err != nil {
+		return object{}, 0, err
+	}
+	size := info.Size()
+	obj := object{ETag: fileETag(info)}
+	if etag != "" && etag == obj.ETag {
+		return obj, size, errNotModified
+	}
+	if offset >= size {
+		return object{}, size, nil
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	obj.Value = make([]byte, length)
+	if _, err := file.ReadAt(obj.Value, offset); err != nil {
+		return object{}, 0, errors.New("could not read: " + err.Error())
+	}
+	return obj, size, nil
+}
+
+var _ lister = (*dirBackend)(nil)
+
+func (d *dirBackend) List(ctx context.Context, dir string, recursive bool) ([]listEntry, error) {
+	root, err := d.file(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []listEntry
+	err = filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if name == root && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if name == root {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel := filepath.ToSlash(must(filepath.Rel(root, name)))
+		switch {
+		case entry.IsDir() && recursive:
+			return nil
+		case entry.IsDir():
+			if listable(dir, rel+"/") {
+				entries = append(entries, listEntry{Name: rel + "/"})
+			}
+			return fs.SkipDir
+		case !entry.Type().IsRegular() || !listable(dir, rel):
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, listEntry{Name: rel, Size: info.Size(), Modified: info.ModTime()})
+		if len(entries) > maxListEntries {
+			return errors.New("too many entries")
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (d *dirBackend) Test(ctx context.Context, timeout time.Duration) error {
+	info, err := os.Stat(d.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(d.root + " is not a directory")
+	}
+	return nil
+}
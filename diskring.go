@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+var _ iCache = (*diskRing)(nil)
+var _ storer = (*diskRing)(nil)
+var _ invalidator = (*diskRing)(nil)
+
+type CacheDir struct {
+	Dir    string `yaml:"dir"`
+	SizeGB uint16 `yaml:"size"`
+}
+
+type ringPoint struct {
+	hash uint64
+	disk *cache
+}
+
+// diskRing spreads keys over several cache directories by consistent hashing,
+// each directory weighted by its size and accounted in its own index. Keys of
+// a failed directory move to the next healthy one on the ring until it
+// recovers.
+type diskRing struct {
+	disks     []*cache
+	points    []ringPoint
+	onMissing OnMissing
+}
+
+const ringPointsPerGB = 32
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func OpenRing(backend string, dirs []CacheDir, missing OnMissing) iCache {
+	ring := &diskRing{onMissing: missing}
+	for _, dir := range dirs {
+		if dir.SizeGB == 0 {
+			continue
+		}
+		disk, ok := OpenCache(backend, dir.Dir, int64(dir.SizeGB)*1e+9, missing).(*cache)
+		if !ok || disk == nil {
+			fmt.Println("cache dir failed to open:", dir.Dir)
+			continue
+		}
+		ring.disks = append(ring.disks, disk)
+		for i := 0; i < int(dir.SizeGB)*ringPointsPerGB; i++ {
+			ring.points = append(ring.points, ringPoint{ringHash(dir.Dir + "#" + strconv.Itoa(i)), disk})
+		}
+	}
+	if len(ring.disks) == 0 {
+		if len(dirs) > 0 {
+			panic(errors.New("no usable cache dir"))
+		}
+		return missing
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return ring
+}
+
+// disk returns the first healthy disk at or after the hash of key.
+func (r *diskRing) disk(key string) *cache {
+	h := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	for i := range r.points {
+		point := r.points[(start+i)%len(r.points)]
+		if point.disk.healthy() {
+			return point.disk
+		}
+	}
+	return nil
+}
+
+func (r *diskRing) Get(ctx context.Context, key string) (result, error) {
+	disk := r.disk(key)
+	if disk == nil {
+		return r.onMissing.Get(ctx, key)
+	}
+	return disk.Get(ctx, key)
+}
+
+func (r *diskRing) contains(key string) bool {
+	disk := r.disk(key)
+	return disk != nil && disk.contains(key)
+}
+
+func (r *diskRing) invalidate(key string) {
+	if disk := r.disk(key); disk != nil {
+		disk.invalidate(key)
+	}
+}
+
+func (r *diskRing) store(key string, val []byte, meta entryMeta) bool {
+	disk := r.disk(key)
+	return disk != nil && disk.store(key, val, meta)
+}
+
+func (r *diskRing) setPolicy(p *Policy) {
+	for _, disk := range r.disks {
+		disk.setPolicy(p)
+	}
+}
+
+func (r *diskRing) Size() int64 {
+	var sum int64
+	for _, disk := range r.disks {
+		sum += disk.Size()
+	}
+	return sum
+}
+
+func (r *diskRing) Close() error {
+	var err error
+	for _, disk := range r.disks {
+		if e := disk.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
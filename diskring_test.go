@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func openTestRing(t *testing.T) *diskRing {
+	root := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	ring := OpenRing("leveldb", []CacheDir{
+		{filepath.Join(root, "0"), 1},
+		{filepath.Join(root, "1"), 2},
+	}, func(ctx context.Context, key, etag string) (object, error) {
+		return object{Value: []byte(key)}, nil
+	}).(*diskRing)
+	t.Cleanup(func() {
+		_ = ring.Close()
+		_ = os.RemoveAll(root)
+	})
+	return ring
+}
+
+func TestDiskRing_Spread(t *testing.T) {
+	ring := openTestRing(t)
+	for i := 0; i < 100; i++ {
+		key := "/key" + strconv.Itoa(i)
+		result := must(ring.Get(context.Background(), key))
+		assert(result.ValueCached)
+		assert(ring.disk(key) == ring.disk(key))
+	}
+	assert(ring.disks[0].Size() > 0)
+	assert(ring.disks[1].Size() > 0)
+	assert(ring.Size() == ring.disks[0].Size()+ring.disks[1].Size())
+}
+
+// flakyStorage fails with err while it is set.
+type flakyStorage struct {
+	storage
+	err error
+}
+
+func (f *flakyStorage) get(key string) ([]byte, *os.File, error) {
+	if f.err != nil {
+		return nil, nil, f.err
+	}
+	return f.storage.get(key)
+}
+
+func (f *flakyStorage) put(key string, val []byte, entry indexEntry) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.storage.put(key, val, entry)
+}
+
+func TestDiskRing_FailedDisk(t *testing.T) {
+	ring := openTestRing(t)
+	var key string
+	for i := 0; ; i++ {
+		key = "/key" + strconv.Itoa(i)
+		if ring.disk(key) == ring.disks[0] {
+			break
+		}
+	}
+	must(ring.Get(context.Background(), key))
+	flaky := &flakyStorage{ring.disks[0].storage, syscall.ENOSPC}
+	ring.disks[0].storage = flaky
+	for i := 0; i < maxStorageErrors; i++ {
+		assert(ring.disk(key) == ring.disks[0])
+		result := must(ring.Get(context.Background(), key))
+		assert(!result.CacheUsed)
+		assert(bytes.Equal(result.Value, []byte(key)))
+	}
+	assert(ring.disk(key) == ring.disks[1])
+	result := must(ring.Get(context.Background(), key))
+	assert(result.ValueCached)
+	result = must(ring.Get(context.Background(), key))
+	assert(result.CacheUsed)
+
+	flaky.err = nil
+	assert(ring.disk(key) == ring.disks[1])
+	ring.disks[0].failedAt.Store(time.Now().Add(-probeInterval).UnixNano())
+	assert(ring.disk(key) == ring.disks[0])
+	result = must(ring.Get(context.Background(), key))
+	assert(result.CacheUsed)
+
+	flaky.err = syscall.EIO
+	must(ring.Get(context.Background(), key))
+	assert(ring.disk(key) == ring.disks[1])
+}
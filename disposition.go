@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+const (
+	claimFilename    = "filename"
+	claimDisposition = "disposition"
+)
+
+// disposition returns the Content-Disposition asked by claims, if any. A
+// filename alone means attachment.
+func disposition(claims url.Values) (string, error) {
+	filename, kind := claims.Get(claimFilename), claims.Get(claimDisposition)
+	switch kind {
+	case "":
+		if filename == "" {
+			return "", nil
+		}
+		kind = "attachment"
+	case "attachment", "inline":
+	default:
+		return "", errors.New("invalid disposition")
+	}
+	if filename == "" {
+		return kind, nil
+	}
+	if len(filename) > 255 || strings.ContainsAny(filename, `/\`) || strings.IndexFunc(filename, unicode.IsControl) >= 0 {
+		return "", errors.New("invalid filename")
+	}
+	return contentDisposition(kind, filename), nil
+}
+
+// contentDisposition follows RFC 6266, with an ASCII filename for clients
+// not supporting filename*.
+func contentDisposition(kind, filename string) string {
+	fallback := []rune(filename)
+	for i, r := range fallback {
+		if r > unicode.MaxASCII || r == '"' || r == '\\' || r == '%' {
+			fallback[i] = '_'
+		}
+	}
+	return kind + `; filename="` + string(fallback) + `"; filename*=UTF-8''` + encodeRFC5987(filename)
+}
+
+// encodeRFC5987 percent-encodes all but the attr-char of RFC 5987.
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	out := &strings.Builder{}
+	for _, b := range []byte(s) {
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			out.WriteByte(b)
+			continue
+		}
+		out.WriteByte('%')
+		out.WriteByte(hex[b>>4])
+		out.WriteByte(hex[b&0xf])
+	}
+	return out.String()
+}
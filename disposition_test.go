@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestDisposition(t *testing.T) {
+	for _, c := range []struct {
+		claims   url.Values
+		expected string
+	}{
+		{url.Values{}, ""},
+		{url.Values{"disposition": {"inline"}}, "inline"},
+		{url.Values{"filename": {"Le Fabuleux Destin d’Amélie.mp4"}}, `attachment; filename="Le Fabuleux Destin d_Am_lie.mp4"; filename*=UTF-8''Le%20Fabuleux%20Destin%20d%E2%80%99Am%C3%A9lie.mp4`},
+		{url.Values{"filename": {`a"b%.mkv`}, "disposition": {"inline"}}, `inline; filename="a_b_.mkv"; filename*=UTF-8''a%22b%25.mkv`},
+	} {
+		if got := must(disposition(c.claims)); got != c.expected {
+			t.Errorf("%v: got %s", c.claims, got)
+		}
+	}
+	for _, claims := range []url.Values{
+		{"disposition": {"download"}},
+		{"filename": {"../a.mp4"}},
+		{"filename": {"a\nb.mp4"}},
+	} {
+		if _, err := disposition(claims); err == nil {
+			t.Errorf("%v accepted", claims)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+)
+
+type KeySource struct {
+	File string `yaml:"file"`
+	Env  string `yaml:"env"`
+}
+
+// Encryption configures AES-256-GCM of cached values. The first key encrypts
+// and every key decrypts, so a new key is rotated in by prepending it while
+// values sealed with older keys are kept by the files backend. Values are
+// opened in memory, so objects must be cached by chunks.
+type Encryption struct {
+	Keys []KeySource `yaml:"keys"`
+}
+
+// decodeKey accepts a raw 32 byte key or its base64.
+func decodeKey(b []byte) ([]byte, error) {
+	if len(b) == 32 {
+		return b, nil
+	}
+	s := strings.TrimSpace(string(b))
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if key, err := encoding.DecodeString(s); err == nil && len(key) == 32 {
+			return key, nil
+		}
+	}
+	return nil, errors.New("encryption key is not 32 bytes")
+}
+
+func (k *KeySource) load() ([]byte, error) {
+	var b []byte
+	switch {
+	case k.File != "":
+		var err error
+		if b, err = os.ReadFile(k.File); err != nil {
+			return nil, err
+		}
+	case k.Env != "":
+		b = []byte(os.Getenv(k.Env))
+	default:
+		return nil, errors.New("encryption key without file or env")
+	}
+	return decodeKey(b)
+}
+
+func (e *Encryption) keyring() (*keyring, error) {
+	if len(e.Keys) == 0 {
+		return nil, nil
+	}
+	ring := &keyring{}
+	for _, source := range e.Keys {
+		key, err := source.load()
+		if err != nil {
+			return nil, err
+		}
+		if err := ring.add(key); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+const keyIDSize = 4
+
+type sealKey struct {
+	id   [keyIDSize]byte
+	aead cipher.AEAD
+}
+
+type keyring struct {
+	keys []sealKey
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// overhead is the size a sealed value adds to its plaintext.
+func (k *keyring) overhead() int64 {
+	aead := k.keys[0].aead
+	return int64(keyIDSize + aead.NonceSize() + aead.Overhead())
+}
+
+func (k *keyring) add(key []byte) error {
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(key)
+	sk := sealKey{aead: aead}
+	copy(sk.id[:], sum[:])
+	k.keys = append(k.keys, sk)
+	return nil
+}
+
+// seal returns keyID|nonce|ciphertext, authenticating the cache key too so
+// values cannot be swapped between keys.
+func (k *keyring) seal(key string, val []byte) ([]byte, error) {
+	sk := k.keys[0]
+	nonceSize := sk.aead.NonceSize()
+	out := make([]byte, keyIDSize+nonceSize, keyIDSize+nonceSize+len(val)+sk.aead.Overhead())
+	copy(out, sk.id[:])
+	if _, err := rand.Read(out[keyIDSize:]); err != nil {
+		return nil, err
+	}
+	return sk.aead.Seal(out, out[keyIDSize:], val, []byte(key)), nil
+}
+
+var errDecrypt = errors.New("could not decrypt")
+
+func (k *keyring) open(key string, sealed []byte) ([]byte, error) {
+	if len(sealed) < keyIDSize {
+		return nil, errDecrypt
+	}
+	for _, sk := range k.keys {
+		if string(sk.id[:]) != string(sealed[:keyIDSize]) {
+			continue
+		}
+		nonceSize := sk.aead.NonceSize()
+		if len(sealed) < keyIDSize+nonceSize {
+			return nil, errDecrypt
+		}
+		nonce := sealed[keyIDSize : keyIDSize+nonceSize]
+		val, err := sk.aead.Open(nil, nonce, sealed[keyIDSize+nonceSize:], []byte(key))
+		if err != nil {
+			return nil, errDecrypt
+		}
+		return val, nil
+	}
+	return nil, errDecrypt
+}
+
+var _ storage = (*encryptedStorage)(nil)
+
+// encryptedStorage seals values before they reach the disk. Values are read
+// back into memory to be opened, chunked caching keeps them small.
+type encryptedStorage struct {
+	storage
+	keys *keyring
+}
+
+func (e *encryptedStorage) get(key string) ([]byte, *os.File, error) {
+	val, file, err := e.storage.get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if file != nil {
+		res := result{File: file}
+		info, err := file.Stat()
+		if err != nil {
+			Close(file)
+			return nil, nil, err
+		}
+		res.FileSize = info.Size()
+		val, err = res.Bytes()
+		res.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	plain, err := e.keys.open(key, val)
+	if err != nil {
+		metrics.Add("disk.decrypt-failed", 1)
+		return nil, nil, errNotStored
+	}
+	return plain, nil, nil
+}
+
+func (e *encryptedStorage) put(key string, val []byte, entry indexEntry) error {
+	sealed, err := e.keys.seal(key, val)
+	if err != nil {
+		return err
+	}
+	return e.storage.put(key, sealed, entry)
+}
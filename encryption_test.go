@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestKey() []byte {
+	key := make([]byte, 32)
+	must(rand.Read(key))
+	return key
+}
+
+func TestKeyring_Rotation(t *testing.T) {
+	oldKey, newKey := newTestKey(), newTestKey()
+	old := &keyring{}
+	throw(old.add(oldKey))
+	sealed := must(old.seal("/key", []byte("plain")))
+	assert(!bytes.Contains(sealed, []byte("plain")))
+
+	rotated := &keyring{}
+	throw(rotated.add(newKey))
+	throw(rotated.add(oldKey))
+	assert(string(must(rotated.open("/key", sealed))) == "plain")
+	_, err := rotated.open("/other", sealed)
+	assert(err == errDecrypt)
+	resealed := must(rotated.seal("/key", []byte("plain")))
+	_, err = old.open("/key", resealed)
+	assert(err == errDecrypt)
+}
+
+func TestEncryption_Keyring(t *testing.T) {
+	t.Setenv("S3PROXY_TEST_KEY", base64.StdEncoding.EncodeToString(newTestKey()))
+	dir := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	throw(os.MkdirAll(dir, 0700))
+	defer func() { _ = os.RemoveAll(dir) }()
+	throw(os.WriteFile(filepath.Join(dir, "key"), newTestKey(), 0600))
+	ring := must((&Encryption{Keys: []KeySource{
+		{File: filepath.Join(dir, "key")},
+		{Env: "S3PROXY_TEST_KEY"},
+	}}).keyring())
+	assert(len(ring.keys) == 2)
+	_, err := (&Encryption{Keys: []KeySource{{Env: "S3PROXY_MISSING_KEY"}}}).keyring()
+	assert(err != nil)
+}
+
+func TestCache_Encrypted(t *testing.T) {
+	forEachBackend(t, testCache_Encrypted)
+}
+func testCache_Encrypted(t *testing.T, backend string) {
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	c := OpenCache(backend, dbPath, 1000, func(ctx context.Context, key, etag string) (object, error) {
+		return object{Value: []byte("plain film")}, nil
+	}).(*cache)
+	defer func() { _ = c.Close(); _ = os.RemoveAll(dbPath) }()
+	raw := c.storage
+	policy := &Policy{}
+	policy.keys = &keyring{}
+	throw(policy.keys.add(newTestKey()))
+	c.setPolicy(policy)
+	must(c.Get(context.Background(), "/key"))
+	val, file, err := raw.get("/key")
+	throw(err)
+	if file != nil {
+		val = must(os.ReadFile(file.Name()))
+		Close(file)
+	}
+	assert(!bytes.Contains(val, []byte("plain film")))
+	result := must(c.Get(context.Background(), "/key"))
+	assert(result.CacheUsed && string(value(result)) == "plain film")
+	assert(c.Size() == int64(len("plain film"))+32)
+}
+
+func TestCache_EncryptedRotation(t *testing.T) {
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	defer func() { _ = os.RemoveAll(dbPath) }()
+	fetches := 0
+	missing := func(ctx context.Context, key, etag string) (object, error) {
+		fetches++
+		return object{Value: []byte("plain film")}, nil
+	}
+	oldKey, newKey := newTestKey(), newTestKey()
+	openWith := func(keys ...[]byte) iCache {
+		c := OpenCache("files", dbPath, 1000, missing)
+		policy := &Policy{}
+		policy.keys = &keyring{}
+		for _, key := range keys {
+			throw(policy.keys.add(key))
+		}
+		c.(policied).setPolicy(policy)
+		return c
+	}
+	c := openWith(oldKey)
+	must(c.Get(context.Background(), "/key"))
+	throw(c.Close())
+
+	c = openWith(newKey, oldKey)
+	defer func() { _ = c.Close() }()
+	result := must(c.Get(context.Background(), "/key"))
+	assert(result.CacheUsed && string(value(result)) == "plain film" && fetches == 1)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const (
+	envelopeWrapAlg    = "AES/GCM"
+	envelopeContentAlg = "AES/GCM/NoPadding"
+)
+
+// envelope opens objects written by the S3 encryption client (v2 metadata)
+// whose data keys are wrapped with AES/GCM under a master key. Objects without
+// a wrapped key are passed through, so a bucket may mix both.
+type envelope struct {
+	master cipher.AEAD
+}
+
+func newEnvelope(source *KeySource) (*envelope, error) {
+	key, err := source.load()
+	if err != nil {
+		return nil, err
+	}
+	master, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{master}, nil
+}
+
+// metadataValue looks a user metadata key up regardless of its case.
+func metadataValue(metadata map[string]*string, name string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, name) && v != nil {
+			return *v
+		}
+	}
+	return ""
+}
+
+func (e *envelope) open(metadata map[string]*string, content []byte) ([]byte, error) {
+	wrapped := metadataValue(metadata, "x-amz-key-v2")
+	if wrapped == "" {
+		return content, nil
+	}
+	wrapAlg, contentAlg := metadataValue(metadata, "x-amz-wrap-alg"), metadataValue(metadata, "x-amz-cek-alg")
+	if wrapAlg != envelopeWrapAlg || contentAlg != envelopeContentAlg {
+		return nil, errors.New("unsupported envelope encryption " + wrapAlg + " " + contentAlg)
+	}
+	encryptedKey, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := base64.StdEncoding.DecodeString(metadataValue(metadata, "x-amz-iv"))
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := e.master.NonceSize()
+	if len(encryptedKey) < nonceSize {
+		return nil, errDecrypt
+	}
+	//the content algorithm is authenticated with the data key
+	key, err := e.master.Open(nil, encryptedKey[:nonceSize], encryptedKey[nonceSize:], []byte(contentAlg))
+	if err != nil {
+		return nil, errDecrypt
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aead.NonceSize() {
+		return nil, errDecrypt
+	}
+	plain, err := aead.Open(nil, iv, content, nil)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plain, nil
+}
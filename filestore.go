@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var _ storage = (*fileStorage)(nil)
+
+// fileStorage keeps each value in its own file of a tree sharded by the key
+// hash, so large objects are written once and served with sendfile. Each
+// file has a small .meta file next to it, from which the index is rebuilt
+// when the storage is opened again.
+type fileStorage struct {
+	path string
+}
+
+// fileMeta is the content of a .meta file.
+type fileMeta struct {
+	Key      string      `json:"key"`
+	Size     int64       `json:"size"`
+	ETag     string      `json:"etag,omitempty"`
+	Fetched  time.Time   `json:"fetched"`
+	NotFound bool        `json:"not-found,omitempty"`
+	Checksum uint32      `json:"checksum"`
+	Header   http.Header `json:"header,omitempty"`
+}
+
+const metaExt = ".meta"
+
+func OpenFiles(path string, max int64, missing OnMissing) iCache {
+	return open(max, missing, func() (storage, error) {
+		f := &fileStorage{path}
+		if err := f.clean(); err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+}
+
+func (f *fileStorage) objects() string { return filepath.Join(f.path, "objects") }
+func (f *fileStorage) tmp() string     { return filepath.Join(f.path, "tmp") }
+
+// clean removes the leftovers of interrupted puts.
+func (f *fileStorage) clean() error {
+	if err := os.RemoveAll(f.tmp()); err != nil {
+		return err
+	}
+	for _, dir := range []string{f.objects(), f.tmp()} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fileStorage) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	h := hex.EncodeToString(sum[:])
+	return filepath.Join(f.objects(), h[0:2], h[2:4], h)
+}
+
+func (f *fileStorage) get(key string) ([]byte, *os.File, error) {
+	file, err := os.Open(f.name(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, errNotStored
+		}
+		return nil, nil, err
+	}
+	return nil, file, nil
+}
+
+// write atomically replaces name with val.
+func (f *fileStorage) write(name string, val []byte) error {
+	tmp, err := os.CreateTemp(f.tmp(), "put-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(val); err != nil {
+		removeFile(tmp)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// put writes the value before its .meta file, and drops the previous .meta
+// first, so a value is never loaded with the metadata of another one.
+func (f *fileStorage) put(key string, val []byte, entry indexEntry) error {
+	name := f.name(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(fileMeta{
+		Key:      key,
+		Size:     entry.valueSize,
+		ETag:     entry.etag,
+		Fetched:  entry.fetched,
+		NotFound: entry.notFound,
+		Checksum: entry.checksum,
+		Header:   entry.upstream(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := removeIfExists(name + metaExt); err != nil {
+		return err
+	}
+	if err := f.write(name, val); err != nil {
+		return err
+	}
+	return f.write(name+metaExt, meta)
+}
+
+func (f *fileStorage) delete(key string) error {
+	name := f.name(key)
+	if err := removeIfExists(name + metaExt); err != nil {
+		return err
+	}
+	return removeIfExists(name)
+}
+
+// load reads the .meta files, and removes values left without one.
+func (f *fileStorage) load(fn func(key string, entry indexEntry)) error {
+	var orphans []string
+	err := filepath.WalkDir(f.objects(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if !strings.HasSuffix(path, metaExt) {
+			if _, err := os.Stat(path + metaExt); errors.Is(err, fs.ErrNotExist) {
+				orphans = append(orphans, path)
+			}
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(path, metaExt)
+		var meta fileMeta
+		if err := json.Unmarshal(b, &meta); err != nil || f.name(meta.Key) != name {
+			orphans = append(orphans, path, name)
+			return nil
+		}
+		if _, err := os.Stat(name); err != nil {
+			orphans = append(orphans, path)
+			return nil
+		}
+		fn(meta.Key, indexEntry{
+			lastRead:  meta.Fetched.UTC().Unix(),
+			valueSize: meta.Size,
+			entryMeta: entryMeta{
+				etag:     meta.ETag,
+				fetched:  meta.Fetched,
+				notFound: meta.NotFound,
+				checksum: meta.Checksum,
+				header:   metaHeader(meta.Header),
+			},
+		})
+		return nil
+	})
+	for _, orphan := range orphans {
+		if err := removeIfExists(orphan); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// close keeps the values for the next run.
+func (f *fileStorage) close() error {
+	return nil
+}
+
+func removeIfExists(name string) error {
+	err := os.Remove(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+type TTLRule struct {
+	Path string        `yaml:"path"`
+	TTL  time.Duration `yaml:"ttl"`
+}
+
+// Freshness decides how long cached entries are served before they are
+// revalidated against the origin with their ETag. A zero TTL never expires.
+// Objects missing in every source are remembered for NotFoundTTL.
+type Freshness struct {
+	TTL                  time.Duration `yaml:"ttl"`
+	Rules                []TTLRule     `yaml:"rules"`
+	StaleWhileRevalidate time.Duration `yaml:"stale-while-revalidate"`
+	StaleIfError         time.Duration `yaml:"stale-if-error"`
+	NotFoundTTL          time.Duration `yaml:"not-found-ttl"`
+	//clock of entry ages, time.Now when nil
+	now func() time.Time
+}
+
+type freshState int
+
+const (
+	fresh freshState = iota
+	// staleRevalidate is served while revalidated in background
+	staleRevalidate
+	// stale must be revalidated before served
+	stale
+)
+
+// ttl returns the TTL of the first rule whose glob matches the key or its
+// base name. Chunk keys use the TTL of their object.
+func (f *Freshness) ttl(key string) time.Duration {
+	if f == nil {
+		return 0
+	}
+	//chunks and derived entries share the ttl of their object
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		key = key[:i]
+	}
+	for _, rule := range f.Rules {
+		if ok, _ := path.Match(rule.Path, key); ok {
+			return rule.TTL
+		}
+		if ok, _ := path.Match(rule.Path, path.Base(key)); ok {
+			return rule.TTL
+		}
+	}
+	return f.TTL
+}
+
+func (f *Freshness) notFoundTTL() time.Duration {
+	if f == nil {
+		return 0
+	}
+	return f.NotFoundTTL
+}
+
+func (f *Freshness) age(fetched time.Time) time.Duration {
+	if f == nil || f.now == nil {
+		return time.Since(fetched)
+	}
+	return f.now().Sub(fetched)
+}
+
+// notFoundExpired reports whether a notFound entry fetched then is too old.
+func (f *Freshness) notFoundExpired(fetched time.Time) bool {
+	return f.age(fetched) >= f.notFoundTTL()
+}
+
+func (f *Freshness) state(key string, fetched time.Time) freshState {
+	ttl := f.ttl(key)
+	if ttl <= 0 {
+		return fresh
+	}
+	switch age := f.age(fetched); {
+	case age < ttl:
+		return fresh
+	case age < ttl+f.StaleWhileRevalidate:
+		return staleRevalidate
+	default:
+		return stale
+	}
+}
+
+func (f *Freshness) staleIfError(key string, fetched time.Time) bool {
+	return f != nil && f.age(fetched) < f.ttl(key)+f.StaleIfError
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFreshness_TTL(t *testing.T) {
+	f := &Freshness{
+		TTL: time.Hour,
+		Rules: []TTLRule{
+			{"*.m3u8", time.Second},
+			{"/live/*", time.Minute},
+			{"*.ts", 0},
+		},
+	}
+	assert(f.ttl("/films/a/index.m3u8") == time.Second)
+	assert(f.ttl("/live/a.mp4") == time.Minute)
+	assert(f.ttl("/films/a/1.ts") == 0)
+	assert(f.ttl("/films/a/1.ts:3") == 0)
+	assert(f.ttl("/films/a/poster.jpg") == time.Hour)
+	assert((*Freshness)(nil).ttl("/a.m3u8") == 0)
+	assert(f.state("/a.ts", time.Time{}) == fresh)
+}
+
+// testClock is a Freshness clock moved forward by tests.
+type testClock struct {
+	offset time.Duration
+}
+
+func (c *testClock) now() time.Time {
+	return time.Now().Add(c.offset)
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.offset += d
+}
+
+type versionedOrigin struct {
+	value []byte
+	etag  string
+	err   error
+	hits  int
+}
+
+func (o *versionedOrigin) fetch(ctx context.Context, key, etag string) (object, error) {
+	o.hits++
+	if o.err != nil {
+		return object{}, o.err
+	}
+	if etag != "" && etag == o.etag {
+		return object{ETag: etag}, errNotModified
+	}
+	return object{Value: o.value, ETag: o.etag}, nil
+}
+
+func TestCache_Revalidate(t *testing.T) {
+	origin := &versionedOrigin{value: []byte("v1"), etag: `"1"`}
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	c := Open(dbPath, 1000, origin.fetch)
+	defer func() { _ = c.Close() }()
+	clock := &testClock{}
+	c.(policied).setPolicy(&Policy{Freshness: Freshness{TTL: time.Minute, StaleIfError: time.Hour, now: clock.now}})
+
+	result := must(c.Get(context.Background(), "/key"))
+	assert(!result.CacheUsed && string(result.Value) == "v1")
+	result = must(c.Get(context.Background(), "/key"))
+	assert(result.CacheUsed && origin.hits == 1)
+
+	clock.advance(2 * time.Minute)
+	result = must(c.Get(context.Background(), "/key"))
+	assert(result.CacheUsed && string(result.Value) == "v1" && origin.hits == 2)
+
+	clock.advance(2 * time.Minute)
+	origin.value, origin.etag = []byte("v2"), `"2"`
+	result = must(c.Get(context.Background(), "/key"))
+	assert(!result.CacheUsed && result.ValueCached && string(result.Value) == "v2")
+
+	clock.advance(2 * time.Minute)
+	origin.err = errors.New("down")
+	result = must(c.Get(context.Background(), "/key"))
+	assert(result.CacheUsed && string(result.Value) == "v2")
+
+	origin.err = nil
+	origin.value, origin.etag = nil, ""
+	clock.advance(2 * time.Minute)
+	result = must(c.Get(context.Background(), "/key"))
+	assert(len(result.Value) == 0)
+	assert(c.Size() == 0)
+}
+
+func TestCache_StaleWhileRevalidate(t *testing.T) {
+	origin := &versionedOrigin{value: []byte("v1"), etag: `"1"`}
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	c := Open(dbPath, 1000, origin.fetch).(*cache)
+	defer func() { _ = c.Close() }()
+	clock := &testClock{}
+	c.setPolicy(&Policy{Freshness: Freshness{TTL: time.Minute, StaleWhileRevalidate: time.Hour, now: clock.now}})
+	must(c.Get(context.Background(), "/key"))
+	clock.advance(2 * time.Minute)
+	origin.value, origin.etag = []byte("v2"), `"2"`
+	result := must(c.Get(context.Background(), "/key"))
+	assert(result.CacheUsed && string(result.Value) == "v1")
+	for i := 0; i < 100; i++ {
+		if _, running := c.revalidating.Load("/key"); !running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	result = must(c.Get(context.Background(), "/key"))
+	assert(result.CacheUsed && string(result.Value) == "v2")
+}
+
+func TestCache_NotFound(t *testing.T) {
+	origin := &versionedOrigin{}
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	c := Open(dbPath, 1000, origin.fetch)
+	defer func() { _ = c.Close() }()
+	clock := &testClock{}
+	c.(policied).setPolicy(&Policy{Freshness: Freshness{NotFoundTTL: time.Minute, now: clock.now}})
+	result := must(c.Get(context.Background(), "/missing"))
+	assert(!result.CacheUsed && result.ValueCached && len(result.Value) == 0)
+	result = must(c.Get(context.Background(), "/missing"))
+	assert(result.CacheUsed && len(result.Value) == 0 && origin.hits == 1)
+	assert(c.Size() == notFoundSize)
+	clock.advance(2 * time.Minute)
+	origin.value, origin.etag = []byte("v1"), `"1"`
+	result = must(c.Get(context.Background(), "/missing"))
+	assert(!result.CacheUsed && string(result.Value) == "v1" && origin.hits == 2)
+	assert(c.Size() == 2)
+	for i := 0; i < 10; i++ {
+		must(c.Get(context.Background(), "/missing"+strconv.Itoa(i)))
+	}
+	assert(c.Size() <= 1000)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// HeaderRule changes the headers of responses matching all of its non-empty
+// conditions. Rules apply in order, after the response is complete.
+type HeaderRule struct {
+	//glob on the path or its base name
+	Path string `yaml:"path"`
+	Ext  string `yaml:"ext"`
+	//status code like 404 or class like 4xx
+	Status string            `yaml:"status"`
+	Set    map[string]string `yaml:"set"`
+	Append map[string]string `yaml:"append"`
+	Remove []string          `yaml:"remove"`
+}
+
+// matchPath matches p by extension and by a glob on p or its base name,
+// empty conditions match anything.
+func matchPath(pattern, ext, p string) bool {
+	if ext != "" && !strings.EqualFold(path.Ext(p), ext) {
+		return false
+	}
+	if pattern != "" {
+		ok, _ := path.Match(pattern, p)
+		if base, _ := path.Match(pattern, path.Base(p)); !ok && !base {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *HeaderRule) match(p string, status int) bool {
+	if !matchPath(r.Path, r.Ext, p) {
+		return false
+	}
+	switch code := strconv.Itoa(status); {
+	case r.Status == "", r.Status == code:
+	case len(r.Status) == 3 && strings.HasSuffix(r.Status, "xx") && r.Status[0] == code[0]:
+	default:
+		return false
+	}
+	return true
+}
+
+func (r *HeaderRule) apply(header http.Header) {
+	for _, name := range r.Remove {
+		header.Del(name)
+	}
+	for name, value := range r.Set {
+		header.Set(name, value)
+	}
+	for name, value := range r.Append {
+		header.Add(name, value)
+	}
+}
+
+// ruleWriter applies header rules when the status is written. path starts
+// as the request path and becomes the object path once authorized. noStore
+// keeps responses which must not be stored so whatever the rules set.
+type ruleWriter struct {
+	http.ResponseWriter
+	rules       []HeaderRule
+	path        string
+	noStore     bool
+	wroteHeader bool
+}
+
+func (w *ruleWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for i := range w.rules {
+			if w.rules[i].match(w.path, status) {
+				w.rules[i].apply(w.Header())
+			}
+		}
+		if w.noStore {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *ruleWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps the sendfile path of the wrapped writer for cached files.
+func (w *ruleWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *ruleWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *ruleWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_HeaderRules(t *testing.T) {
+	s := &Server{cacheHeader: "max-age=60", headerRules: []HeaderRule{
+		{Ext: ".m3u8", Set: map[string]string{"Cache-Control": "no-cache"}},
+		{Path: "/films/*/seg-*.ts", Set: map[string]string{"Cache-Control": "immutable, max-age=31536000"}},
+		{Status: "4xx", Set: map[string]string{"Cache-Control": "max-age=10"}, Remove: []string{"X-Robots-Tag"}},
+		{Status: "200", Append: map[string]string{"Timing-Allow-Origin": "*"}},
+	}}
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	s.cache = Open(dbPath, 1e+6, func(ctx context.Context, key, etag string) (object, error) {
+		if key == "/missing.ts" {
+			return object{}, nil
+		}
+		return object{Value: []byte("1")}, nil
+	})
+	defer func() { _ = s.cache.Close() }()
+	for path, expected := range map[string][3]string{
+		"/films/a/index.m3u8": {"no-cache", "noindex, nofollow", "*"},
+		"/films/a/seg-1.ts":   {"immutable, max-age=31536000", "noindex, nofollow", "*"},
+		"/films/a/poster.jpg": {"max-age=60", "noindex, nofollow", "*"},
+		"/missing.ts":         {"max-age=10", "", ""},
+	} {
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		header := recorder.Result().Header
+		got := [3]string{header.Get("Cache-Control"), header.Get("X-Robots-Tag"), header.Get("Timing-Allow-Origin")}
+		if got != expected {
+			t.Errorf("%s: got %q", path, got)
+		}
+	}
+}
+
+// readFromRecorder records whether the body was written with ReadFrom, the
+// sendfile path of net/http, and whether with limited readers nested deeper
+// than sendfile unwraps.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+	nested   bool
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	if limited, ok := src.(*io.LimitedReader); ok {
+		if _, ok := limited.R.(*io.LimitedReader); ok {
+			r.nested = true
+		}
+	}
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestRuleWriter_ReadFrom(t *testing.T) {
+	recorder := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	w := &ruleWriter{ResponseWriter: recorder, path: "/a.mp4", rules: []HeaderRule{{Set: map[string]string{"X-Rule": "1"}}}}
+	http.ServeContent(w, httptest.NewRequest(http.MethodGet, "/a.mp4", nil), "a.mp4", time.Time{}, strings.NewReader("film"))
+	assert(recorder.readFrom && recorder.Body.String() == "film" && recorder.Header().Get("X-Rule") == "1")
+}
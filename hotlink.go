@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HotlinkRule restricts the pages embedding matching paths by their Referer
+// or Origin. The first rule matching a path applies.
+type HotlinkRule struct {
+	Path string `yaml:"path"`
+	Ext  string `yaml:"ext"`
+	//allowed hosts, *.example.com for subdomains
+	Domains []string `yaml:"domains"`
+	//allow requests without Referer and Origin, e.g. apps and direct links
+	AllowEmpty bool `yaml:"allow-empty"`
+	//reject (default), redirect or placeholder
+	Action      string `yaml:"action"`
+	Redirect    string `yaml:"redirect"`
+	Placeholder string `yaml:"placeholder"`
+}
+
+func (r *HotlinkRule) validate() error {
+	switch {
+	case r.Action == "redirect" && r.Redirect == "":
+		return errors.New("hotlink redirect without url")
+	case r.Action == "placeholder" && !validateKey(r.Placeholder):
+		return errors.New("invalid hotlink placeholder " + r.Placeholder)
+	case r.Action != "" && r.Action != "reject" && r.Action != "redirect" && r.Action != "placeholder":
+		return errors.New("unknown hotlink action " + r.Action)
+	}
+	return nil
+}
+
+func matchDomain(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == host || strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// referrer returns the host of the page making the request.
+func referrer(request *http.Request) (string, bool) {
+	for _, value := range []string{request.Header.Get("Origin"), request.Header.Get("Referer")} {
+		if value == "" || value == "null" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil {
+			return "", true
+		}
+		return u.Hostname(), true
+	}
+	return "", false
+}
+
+// hotlinkRule returns the first rule matching p.
+func hotlinkRule(rules []HotlinkRule, p string) *HotlinkRule {
+	for i := range rules {
+		if matchPath(rules[i].Path, rules[i].Ext, p) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// allows reports whether the page making request may embed the path.
+func (r *HotlinkRule) allows(request *http.Request) bool {
+	host, ok := referrer(request)
+	return !ok && r.AllowEmpty || ok && matchDomain(r.Domains, host)
+}
+
+// checkHotlink applies the rule matching p, returning the placeholder to
+// serve instead, or done when the request is already answered. Responses of
+// guarded paths vary by the page asking, and refusals are never stored, over
+// header rules too. Placeholders are served without upstream headers.
+func (s *Server) checkHotlink(writer http.ResponseWriter, request *http.Request, p string) (placeholder string, done bool) {
+	rule := hotlinkRule(s.hotlink, p)
+	if rule == nil {
+		return "", false
+	}
+	writer.Header().Add("Vary", "Origin, Referer")
+	if rule.allows(request) {
+		return "", false
+	}
+	writer.Header().Set("Cache-Control", "no-store")
+	if rules, ok := writer.(*ruleWriter); ok {
+		rules.noStore = true
+	}
+	switch rule.Action {
+	case "redirect":
+		metrics.Add("hotlink.redirected", 1)
+		http.Redirect(writer, request, rule.Redirect, http.StatusFound)
+		return "", true
+	case "placeholder":
+		metrics.Add("hotlink.placeholder", 1)
+		return rule.Placeholder, false
+	default:
+		metrics.Add("hotlink.rejected", 1)
+		http.Error(writer, "hotlinking not allowed", http.StatusForbidden)
+		return "", true
+	}
+}
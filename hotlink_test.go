@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServer_Hotlink(t *testing.T) {
+	s := &Server{hotlink: []HotlinkRule{
+		{Ext: ".jpg", Domains: []string{"*.brand.example"}, Action: "placeholder", Placeholder: "/hotlink.png"},
+		{Path: "/films/*", Domains: []string{"brand.example", "*.brand.example"}, AllowEmpty: true, Action: "redirect", Redirect: "https://brand.example/"},
+		{Ext: ".mp4", Domains: []string{"brand.example"}},
+		{Ext: ".zip", Domains: []string{"brand.example"}},
+	}, lists: (&Listing{Enabled: true}).cache(), cacheHeader: "max-age=60"}
+	for i := range s.hotlink {
+		throw(s.hotlink[i].validate())
+	}
+	assert((&HotlinkRule{Action: "placeholder", Placeholder: "none"}).validate() != nil)
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	s.cache = Open(dbPath, 1e+6, func(ctx context.Context, key, etag string) (object, error) {
+		return object{Value: []byte(key)}, nil
+	})
+	defer func() { _ = s.cache.Close() }()
+	get := func(path, header, value string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		if header != "" {
+			request.Header.Set(header, value)
+		}
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, request)
+		return recorder
+	}
+	recorder := get("/posters/a.jpg", "Referer", "https://www.brand.example/page")
+	assert(recorder.Body.String() == "/posters/a.jpg" && recorder.Header().Get("Vary") == "Origin, Referer")
+	assert(recorder.Header().Get("Cache-Control") == "max-age=60")
+	recorder = get("/posters/a.jpg", "Referer", "https://pirate.example/page")
+	assert(recorder.Body.String() == "/hotlink.png" && recorder.Header().Get("Content-Type") == "image/png")
+	assert(recorder.Header().Get("Cache-Control") == "no-store" && recorder.Header().Get("Vary") == "Origin, Referer")
+	assert(get("/films/a.mp4", "Origin", "https://brand.example").Code == http.StatusOK)
+	assert(get("/films/a.mp4", "", "").Code == http.StatusOK)
+	recorder = get("/films/a.mp4", "Origin", "https://pirate.example")
+	assert(recorder.Code == http.StatusFound && recorder.Header().Get("Location") == "https://brand.example/")
+	assert(recorder.Header().Get("Cache-Control") == "no-store")
+	assert(get("/films/", "Origin", "https://pirate.example").Code == http.StatusFound)
+	assert(get("/clips.zip", "Origin", "https://pirate.example").Code == http.StatusForbidden)
+	recorder = get("/clips/a.mp4", "", "")
+	assert(recorder.Code == http.StatusForbidden && recorder.Header().Get("Cache-Control") == "no-store")
+	assert(get("/clips/a.mp4", "Referer", "https://brand.example.pirate.example/").Code == http.StatusForbidden)
+	assert(get("/clips/a.txt", "", "").Code == http.StatusOK)
+}
+
+func TestServer_HotlinkHeaderRules(t *testing.T) {
+	s := &Server{hotlink: []HotlinkRule{
+		{Ext: ".jpg", Domains: []string{"brand.example"}, Action: "placeholder", Placeholder: "/hotlink.png"},
+		{Ext: ".mp4", Domains: []string{"brand.example"}},
+	}, headerRules: []HeaderRule{
+		{Path: "*.jpg", Set: map[string]string{"Cache-Control": "immutable, max-age=31536000"}},
+		{Ext: ".mp4", Set: map[string]string{"Cache-Control": "immutable, max-age=31536000"}},
+		{Status: "4xx", Set: map[string]string{"Cache-Control": "max-age=10"}},
+	}, upstream: newUpstreamAllowlist([]string{"Cache-Control"})}
+	for i := range s.hotlink {
+		throw(s.hotlink[i].validate())
+	}
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	s.cache = Open(dbPath, 1e+6, func(ctx context.Context, key, etag string) (object, error) {
+		return object{Value: []byte(key), Header: http.Header{"Cache-Control": {"max-age=600"}}}, nil
+	})
+	defer func() { _ = s.cache.Close() }()
+	get := func(path, referer string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.Header.Set("Referer", referer)
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, request)
+		return recorder
+	}
+	recorder := get("/a.jpg", "https://brand.example/")
+	assert(recorder.Body.String() == "/a.jpg" && recorder.Header().Get("Cache-Control") == "immutable, max-age=31536000")
+	recorder = get("/a.jpg", "https://pirate.example/")
+	assert(recorder.Body.String() == "/hotlink.png" && recorder.Header().Get("Cache-Control") == "no-store")
+	recorder = get("/a.mp4", "https://pirate.example/")
+	assert(recorder.Code == http.StatusForbidden && recorder.Header().Get("Cache-Control") == "no-store")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ Backend = (*httpBackend)(nil)
+
+// httpBackend fetches objects from a plain HTTP(S) origin, host joined with
+// root and the object path.
+type httpBackend struct {
+	base    string
+	headers http.Header
+	client  *http.Client
+}
+
+func newHTTPBackend(source *Source) (*httpBackend, error) {
+	base, err := url.Parse(source.Host)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, errors.New("http source host is not an http(s) url")
+	}
+	headers := http.Header{}
+	for key, value := range source.Headers {
+		headers.Set(key, value)
+	}
+	return &httpBackend{
+		base:    strings.TrimSuffix(base.String(), "/") + "/" + strings.Trim(source.Root, "/"),
+		headers: headers,
+		client:  &http.Client{},
+	}, nil
+}
+
+func (h *httpBackend) url(path string) string {
+	return strings.TrimSuffix(h.base, "/") + (&url.URL{Path: "/" + strings.TrimPrefix(path, "/")}).EscapedPath()
+}
+
+func (h *httpBackend) do(ctx context.Context, method, path string, header http.Header) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, h.url(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range h.headers {
+		request.Header[key] = values
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	return h.client.Do(request)
+}
+
+func (h *httpBackend) get(ctx context.Context, path, etag string, header http.Header) (*http.Response, object, error) {
+	if etag != "" {
+		header = header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("If-None-Match", etag)
+	}
+	response, err := h.do(ctx, http.MethodGet, path, header)
+	if err != nil {
+		return nil, object{}, err
+	}
+	defer Close(response.Body)
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusNotModified:
+		return nil, object{ETag: etag}, errNotModified
+	case http.StatusNotFound, http.StatusGone, http.StatusRequestedRangeNotSatisfiable:
+		return nil, object{}, nil
+	default:
+		return nil, object{}, errors.New("origin status " + strconv.Itoa(response.StatusCode))
+	}
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, object{}, errors.New("could not download: " + err.Error())
+	}
+	if response.ContentLength >= 0 && int64(len(content)) != response.ContentLength {
+		return nil, object{}, errors.New("failed to read body")
+	}
+	return response, object{Value: content, ETag: response.Header.Get("ETag"), Header: originHeader(response.Header)}, nil
+}
+
+func (h *httpBackend) Download(ctx context.Context, path, etag string) (object, error) {
+	response, obj, err := h.get(ctx, path, etag, nil)
+	if err != nil || response == nil {
+		return obj, err
+	}
+	if err := verifyDigest("md5", response.Header.Get("Content-MD5"), obj.Value); err != nil {
+		return object{}, err
+	}
+	return obj, nil
+}
+
+// DownloadRange slices the body itself when the origin ignores Range.
+func (h *httpBackend) DownloadRange(ctx context.Context, path, etag string, offset, length int64) (object, int64, error) {
+	response, obj, err := h.get(ctx, path, etag, http.Header{"Range": {httpRange(offset, length)}})
+	if err != nil || response == nil {
+		return obj, 0, err
+	}
+	if response.StatusCode == http.StatusPartialContent {
+		total, err := parseContentRange(response.Header.Get("Content-Range"))
+		if err != nil {
+			return object{}, 0, err
+		}
+		return obj, total, nil
+	}
+	obj, total := sliceObject(obj, offset, length)
+	return obj, total, nil
+}
+
+func (h *httpBackend) Test(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	response, err := h.do(ctx, http.MethodHead, "/", nil)
+	if err != nil {
+		return err
+	}
+	Close(response.Body)
+	if response.StatusCode >= 500 {
+		return errors.New("origin status " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	claimWidth   = "w"
+	claimHeight  = "h"
+	claimFit     = "fit"
+	claimFormat  = "format"
+	claimQuality = "q"
+)
+
+// Images limits the output of resized .jpg and .png objects.
+type Images struct {
+	//pixels, default 2048
+	MaxWidth  int `yaml:"max-width"`
+	MaxHeight int `yaml:"max-height"`
+}
+
+const (
+	defaultImageMax = 2048
+	maxSourcePixels = 64 << 20
+	maxImageSize    = 64 << 20
+	imageSuffix     = ":img"
+)
+
+// transform is encoded in the cache key of a variant, so it is canonical.
+type transform struct {
+	width, height int
+	//contain (default), cover or fill
+	fit string
+	//jpeg or png
+	format  string
+	quality int
+}
+
+func imageFormat(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".png":
+		return "png"
+	}
+	return ""
+}
+
+// parseTransform returns nil when claims do not ask for a transform.
+func (i *Images) parseTransform(claims url.Values, ext string) (*transform, error) {
+	if !claims.Has(claimWidth) && !claims.Has(claimHeight) && !claims.Has(claimFit) && !claims.Has(claimFormat) && !claims.Has(claimQuality) {
+		return nil, nil
+	}
+	t := &transform{fit: claims.Get(claimFit), format: claims.Get(claimFormat), quality: 85}
+	if imageFormat(ext) == "" {
+		return nil, errors.New("not a jpg or png image")
+	}
+	if t.format == "" {
+		t.format = imageFormat(ext)
+	}
+	maxWidth, maxHeight := i.MaxWidth, i.MaxHeight
+	if maxWidth == 0 {
+		maxWidth = defaultImageMax
+	}
+	if maxHeight == 0 {
+		maxHeight = defaultImageMax
+	}
+	for _, v := range []struct {
+		claim    string
+		value    *int
+		min, max int
+	}{
+		{claimWidth, &t.width, 1, maxWidth},
+		{claimHeight, &t.height, 1, maxHeight},
+		{claimQuality, &t.quality, 1, 100},
+	} {
+		if !claims.Has(v.claim) {
+			continue
+		}
+		n, err := strconv.Atoi(claims.Get(v.claim))
+		if err != nil || n < v.min || n > v.max {
+			return nil, errors.New("invalid " + v.claim)
+		}
+		*v.value = n
+	}
+	switch t.fit {
+	case "":
+		t.fit = "contain"
+	case "contain", "cover", "fill":
+	default:
+		return nil, errors.New("invalid fit")
+	}
+	if t.format != "jpeg" && t.format != "png" {
+		return nil, errors.New("invalid format")
+	}
+	return t, nil
+}
+
+func (t *transform) key(filePath string) string {
+	return filePath + imageSuffix + strings.Join([]string{
+		strconv.Itoa(t.width), strconv.Itoa(t.height), t.fit, t.format, strconv.Itoa(t.quality),
+	}, ",")
+}
+
+func parseTransformKey(key string) (string, *transform, bool) {
+	i := strings.LastIndex(key, imageSuffix)
+	if i < 0 {
+		return "", nil, false
+	}
+	parts := strings.Split(key[i+len(imageSuffix):], ",")
+	if len(parts) != 5 {
+		return "", nil, false
+	}
+	t := &transform{fit: parts[2], format: parts[3]}
+	var err [3]error
+	t.width, err[0] = strconv.Atoi(parts[0])
+	t.height, err[1] = strconv.Atoi(parts[1])
+	t.quality, err[2] = strconv.Atoi(parts[4])
+	if err[0] != nil || err[1] != nil || err[2] != nil {
+		return "", nil, false
+	}
+	return key[:i], t, true
+}
+
+// imageFetcher renders the variants requested under transform keys.
+func (s *Server) imageFetcher(next OnMissing) OnMissing {
+	return func(ctx context.Context, key, etag string) (object, error) {
+		original, t, ok := parseTransformKey(key)
+		if !ok {
+			return next(ctx, key, etag)
+		}
+		res, content, err := s.content(ctx, ctx, original)
+		if err != nil || content == nil {
+			return object{}, err
+		}
+		defer res.Close()
+		if etag != "" && etag == res.meta.etag {
+			return object{ETag: etag}, errNotModified
+		}
+		src, err := io.ReadAll(io.LimitReader(content, maxImageSize+1))
+		if err != nil {
+			return object{}, err
+		}
+		if len(src) > maxImageSize {
+			return object{}, errors.New("image too large")
+		}
+		value, err := t.apply(src)
+		if err != nil {
+			return object{}, err
+		}
+		metrics.Add("image.rendered", 1)
+		return object{Value: value, ETag: res.meta.etag}, nil
+	}
+}
+
+func (t *transform) apply(src []byte) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxSourcePixels {
+		return nil, errors.New("image has too many pixels")
+	}
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	crop, width, height := t.geometry(img.Bounds())
+	var dst draw.Image = image.NewRGBA(image.Rect(0, 0, width, height))
+	if t.format == "jpeg" {
+		//jpeg has no alpha, flatten on white
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	}
+	scaled := image.NewRGBA(dst.Bounds())
+	scale(scaled, img, crop)
+	draw.Draw(dst, dst.Bounds(), scaled, image.Point{}, draw.Over)
+	out := &bytes.Buffer{}
+	if t.format == "jpeg" {
+		err = jpeg.Encode(out, dst, &jpeg.Options{Quality: t.quality})
+	} else {
+		err = png.Encode(out, dst)
+	}
+	return out.Bytes(), err
+}
+
+// geometry returns the part of bounds to draw and the output size. Images are
+// never enlarged except by fill.
+func (t *transform) geometry(bounds image.Rectangle) (image.Rectangle, int, int) {
+	sw, sh := bounds.Dx(), bounds.Dy()
+	w, h := t.width, t.height
+	switch {
+	case w == 0 && h == 0:
+		return bounds, sw, sh
+	case t.fit == "fill" && w > 0 && h > 0:
+		return bounds, w, h
+	case t.fit == "cover" && w > 0 && h > 0:
+		//crop the source to the output aspect ratio
+		crop := bounds
+		if sw*h > sh*w {
+			cw := sh * w / h
+			crop.Min.X += (sw - cw) / 2
+			crop.Max.X = crop.Min.X + cw
+		} else {
+			ch := sw * h / w
+			crop.Min.Y += (sh - ch) / 2
+			crop.Max.Y = crop.Min.Y + ch
+		}
+		if w > crop.Dx() || h > crop.Dy() {
+			return crop, crop.Dx(), crop.Dy()
+		}
+		return crop, w, h
+	}
+	//contain, also used by cover and fill given a single dimension
+	switch {
+	case w == 0:
+		w = sw * h / sh
+	case h == 0, sw*h > sh*w:
+		h = sh * w / sw
+	default:
+		w = sw * h / sh
+	}
+	if w > sw || h > sh {
+		w, h = sw, sh
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return bounds, w, h
+}
+
+// scale averages the source pixels covered by each destination pixel.
+func scale(dst *image.RGBA, src image.Image, crop image.Rectangle) {
+	dw, dh := dst.Bounds().Dx(), dst.Bounds().Dy()
+	cw, ch := crop.Dx(), crop.Dy()
+	for y := 0; y < dh; y++ {
+		y0 := crop.Min.Y + y*ch/dh
+		y1 := crop.Min.Y + (y+1)*ch/dh
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			x0 := crop.Min.X + x*cw/dw
+			x1 := crop.Min.X + (x+1)*cw/dw
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(b / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTransform_Geometry(t *testing.T) {
+	bounds := image.Rect(0, 0, 400, 200)
+	for _, c := range []struct {
+		t             transform
+		crop          image.Rectangle
+		width, height int
+	}{
+		{transform{width: 100, fit: "contain"}, bounds, 100, 50},
+		{transform{height: 100, fit: "cover"}, bounds, 200, 100},
+		{transform{width: 100, height: 100, fit: "contain"}, bounds, 100, 50},
+		{transform{width: 100, height: 100, fit: "cover"}, image.Rect(100, 0, 300, 200), 100, 100},
+		{transform{width: 100, height: 100, fit: "fill"}, bounds, 100, 100},
+		{transform{width: 800, fit: "contain"}, bounds, 400, 200},
+		{transform{fit: "contain"}, bounds, 400, 200},
+	} {
+		crop, width, height := c.t.geometry(bounds)
+		if crop != c.crop || width != c.width || height != c.height {
+			t.Errorf("%+v: got %v %dx%d", c.t, crop, width, height)
+		}
+	}
+}
+
+func TestServer_Image(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for i := range src.Pix {
+		src.Pix[i] = 0xff
+	}
+	src.Set(0, 0, color.Black)
+	buf := &bytes.Buffer{}
+	throw(png.Encode(buf, src))
+	hits := 0
+	s := &Server{images: Images{MaxWidth: 1000}}
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	s.cache = Open(dbPath, 1e+7, s.imageFetcher(func(ctx context.Context, key, etag string) (object, error) {
+		hits++
+		return object{Value: buf.Bytes()}, nil
+	}))
+	defer func() { _ = s.cache.Close() }()
+	get := func(url string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+		return recorder
+	}
+	for i := 0; i < 2; i++ {
+		recorder := get("/poster.png?w=100&format=jpeg&q=70")
+		assert(recorder.Code == http.StatusOK)
+		assert(recorder.Header().Get("Content-Type") == "image/jpeg")
+		img, format := must2(image.Decode(recorder.Body))
+		assert(format == "jpeg" && img.Bounds().Dx() == 100 && img.Bounds().Dy() == 50)
+	}
+	assert(hits == 1)
+	img, _ := must2(image.Decode(get("/poster.png?w=50&h=50&fit=cover").Body))
+	assert(img.Bounds().Dx() == 50 && img.Bounds().Dy() == 50)
+	assert(get("/poster.png?w=2000").Code == http.StatusBadRequest)
+	assert(get("/poster.png?fit=stretch").Code == http.StatusBadRequest)
+	assert(get("/notes.txt?w=10").Code == http.StatusBadRequest)
+}
+
+func must2[A, B any](a A, b B, err error) (A, B) {
+	throw(err)
+	return a, b
+}
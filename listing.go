@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxListEntries bounds the listing of a directory.
+const maxListEntries = 10000
+
+// listEntry is named relative to the listed directory, sub directories end
+// with a slash.
+type listEntry struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified,omitempty"`
+}
+
+// lister is implemented by backends able to list a directory, recursively
+// or one level deep.
+type lister interface {
+	List(ctx context.Context, dir string, recursive bool) ([]listEntry, error)
+}
+
+var errNoListing = errors.New("listing not supported by sources")
+
+// List merges the listings of all backends supporting it, an entry of an
+// earlier backend wins like it does for downloads.
+func (o *Origin) List(ctx context.Context, dir string, recursive bool) ([]listEntry, error) {
+	if err := validateOriginKey(dir); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var entries []listEntry
+	listed := false
+	for _, backend := range o.backends {
+		l, ok := backend.(lister)
+		if !ok {
+			continue
+		}
+		listed = true
+		backendEntries, err := listTimeout(ctx, l, dir, recursive, o.defaultTimeout)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range backendEntries {
+			if seen[entry.Name] {
+				continue
+			}
+			seen[entry.Name] = true
+			entries = append(entries, entry)
+		}
+		if len(entries) > maxListEntries {
+			return nil, errors.New("too many entries")
+		}
+	}
+	if !listed {
+		return nil, errNoListing
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+func listTimeout(ctx context.Context, l lister, dir string, recursive bool, timeout time.Duration) ([]listEntry, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return l.List(ctx, dir, recursive)
+}
+
+// listable drops entries which could not be requested as keys under dir.
+func listable(dir, name string) bool {
+	if strings.HasSuffix(name, "/") {
+		return validatePath(dir + "/" + strings.TrimSuffix(name, "/"))
+	}
+	return validateKey(dir + "/" + name)
+}
+
+// Listing serves the entries of signed directories for paths ending with a
+// slash, as JSON or as HTML to browsers.
+type Listing struct {
+	Enabled bool `yaml:"enabled"`
+	//default 10s
+	TTL time.Duration `yaml:"ttl"`
+}
+
+const maxCachedLists = 1024
+
+type cachedList struct {
+	entries []listEntry
+	expires time.Time
+}
+
+// listCache keeps listings for a short TTL.
+type listCache struct {
+	ttl   time.Duration
+	mutex sync.Mutex
+	lists map[string]cachedList
+}
+
+func (l *Listing) cache() *listCache {
+	if !l.Enabled {
+		return nil
+	}
+	ttl := l.TTL
+	if ttl == 0 {
+		ttl = 10 * time.Second
+	}
+	return &listCache{ttl: ttl, lists: map[string]cachedList{}}
+}
+
+func (c *listCache) get(ctx context.Context, origin *Origin, dir string) ([]listEntry, error) {
+	now := time.Now()
+	c.mutex.Lock()
+	cached, ok := c.lists[dir]
+	c.mutex.Unlock()
+	if ok && now.Before(cached.expires) {
+		metrics.Add("listing.hit", 1)
+		return cached.entries, nil
+	}
+	entries, err := origin.List(ctx, dir, false)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.lists) >= maxCachedLists {
+		for key, list := range c.lists {
+			if now.After(list.expires) {
+				delete(c.lists, key)
+			}
+		}
+		if len(c.lists) >= maxCachedLists {
+			c.lists = map[string]cachedList{}
+		}
+	}
+	c.lists[dir] = cachedList{entries, now.Add(c.ttl)}
+	return entries, nil
+}
+
+var listTemplate = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Dir}}</title></head><body>
+<h1>{{.Dir}}</h1>
+<ul>
+{{range .Entries}}<li><a href="{{.Name}}">{{.Name}}</a>{{if .Size}} {{.Size}}{{end}}</li>
+{{end}}</ul>
+</body></html>
+`))
+
+func (s *Server) serveListing(writer http.ResponseWriter, request *http.Request, dir string) {
+	entries, err := s.lists.get(request.Context(), s.origin, dir)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(entries) == 0 {
+		http.NotFound(writer, request)
+		return
+	}
+	listing := struct {
+		Dir     string      `json:"dir"`
+		Entries []listEntry `json:"entries"`
+	}{dir, entries}
+	writer.Header().Add("Vary", "Accept")
+	if strings.Contains(request.Header.Get("Accept"), "text/html") {
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = listTemplate.Execute(writer, listing)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(listing)
+}
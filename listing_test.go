@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Listing(t *testing.T) {
+	root := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	defer func() { _ = os.RemoveAll(root) }()
+	writeFiles(root, map[string]string{"season/e1.mp4": "1", "season/subs/en.vtt": "1"})
+	public, key := must2(ed25519.GenerateKey(rand.Reader))
+	s := &Server{
+		publicKeys: []ed25519.PublicKey{public},
+		origin:     &Origin{backends: []Backend{must(newDirBackend(&Source{Root: root}))}},
+		lists:      (&Listing{Enabled: true, TTL: time.Hour}).cache(),
+	}
+	url := "/" + genAuth("season", time.Now().Add(time.Minute), key) + "/"
+	get := func(url, accept string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, url, nil)
+		request.Header.Set("Accept", accept)
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, request)
+		return recorder
+	}
+	recorder := get(url, "")
+	assert(recorder.Code == http.StatusOK)
+	var listing struct {
+		Dir     string
+		Entries []listEntry
+	}
+	throw(json.Unmarshal(recorder.Body.Bytes(), &listing))
+	assert(listing.Dir == "/season" && len(listing.Entries) == 2)
+	assert(listing.Entries[0].Name == "e1.mp4" && listing.Entries[1].Name == "subs/")
+	writeFiles(root, map[string]string{"season/e2.mp4": "2"})
+	recorder = get(url, "text/html,*/*")
+	assert(strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/html"))
+	assert(strings.Contains(recorder.Body.String(), `<a href="e1.mp4">`))
+	//cached
+	assert(!strings.Contains(recorder.Body.String(), "e2.mp4"))
+	assert(get("/"+genAuth("other", time.Now().Add(time.Minute), key)+"/", "").Code == http.StatusNotFound)
+	assert(get(strings.Replace(url, "season", "seasons", 1), "").Code == http.StatusUnauthorized)
+}
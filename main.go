@@ -18,12 +18,15 @@ import (
 var config struct {
 	S3Proxy string `yaml:"s3proxy"`
 	Server  struct {
-		Addr string `yaml:"addr"`
-		TLS  struct {
+		Addr    string `yaml:"addr"`
+		Metrics string `yaml:"metrics"`
+		TLS     struct {
 			ACME struct {
 				Domain   string `yaml:"domain"`
 				CacheDir string `yaml:"cache-dir"`
 				Email    string `yaml:"email"`
+				//accept the terms of service of the CA
+				AcceptTOS bool `yaml:"accept-tos"`
 			} `yaml:"acme"`
 			Key  string `yaml:"key"`
 			Cert string `yaml:"cert"`
@@ -34,20 +37,23 @@ var config struct {
 			Idle  time.Duration `yaml:"idle"`
 		} `yaml:"timeouts"`
 		Headers struct {
-			CORS  string `yaml:"cors"`
-			Cache string `yaml:"cache"`
+			CORS     string       `yaml:"cors"`
+			Cache    string       `yaml:"cache"`
+			Upstream []string     `yaml:"upstream"`
+			Rules    []HeaderRule `yaml:"rules"`
 		} `yaml:"headers"`
 	} `yaml:"server"`
-	Source struct {
-		List    []Source      `yaml:"list"`
-		Test    bool          `yaml:"test,omitempty"`
-		Timeout time.Duration `yaml:"timeout"`
-	} `yaml:"source"`
-	PublicKeys []string `yaml:"public-keys"`
-	Cache      struct {
-		SizeGB uint16 `yaml:"size"`
-		Dir    string `yaml:"dir"`
-	} `yaml:"cache"`
+	Source      SiteSource    `yaml:"source"`
+	PublicKeys  []string      `yaml:"public-keys"`
+	Cache       SiteCache     `yaml:"cache"`
+	Compression Compression   `yaml:"compression"`
+	Images      Images        `yaml:"images"`
+	Listing     Listing       `yaml:"listing"`
+	CORS        CORS          `yaml:"cors"`
+	Hotlink     []HotlinkRule `yaml:"hotlink"`
+	Limits      []RateLimit   `yaml:"limits"`
+	Pacing      []Pacing      `yaml:"pacing"`
+	Sites       []SiteConfig  `yaml:"sites"`
 }
 var flagConfig = flag.String("c", "./s3proxy.yaml", "yaml config file path")
 var flagDebug = flag.Bool("debug", false, "debug mode")
@@ -67,29 +73,16 @@ func main() {
 	if config.S3Proxy != "3" {
 		panic(errors.New(`config file does not contains "s3proxy: 3""`))
 	}
-	if len(config.PublicKeys) == 0 {
-		fmt.Println("NO AUTH")
-	}
-	if config.Cache.SizeGB == 0 {
-		fmt.Println("NO CACHE")
-	}
-	publicKeys := mustParsePublicKeys(config.PublicKeys...)
-	client := must(Connect(config.Source.Test, config.Source.Timeout, config.Source.List...))
-	cache := Open(config.Cache.Dir, int64(config.Cache.SizeGB)*1e+9, client.Download)
-	defer Close(cache)
-	server := &Server{
-		publicKeys:  publicKeys,
-		cache:       cache,
-		corsHeader:  config.Server.Headers.CORS,
-		cacheHeader: config.Server.Headers.Cache,
-	}
+	serveMetrics(config.Server.Metrics)
+	router := NewRouter(defaultSite(), config.Sites...)
+	defer Close(router)
 	httpServer := &http.Server{
 		Addr:                         config.Server.Addr,
 		ReadHeaderTimeout:            config.Server.Timeouts.Read,
 		ReadTimeout:                  config.Server.Timeouts.Read,
 		WriteTimeout:                 config.Server.Timeouts.Write,
 		IdleTimeout:                  config.Server.Timeouts.Idle,
-		Handler:                      server,
+		Handler:                      router,
 		MaxHeaderBytes:               5000, //5KB
 		DisableGeneralOptionsHandler: true,
 		ErrorLog:                     log.New(io.Discard, "", 0),
@@ -97,21 +90,80 @@ func main() {
 	throw(serve(httpServer))
 }
 
+// defaultSite builds the site served for hosts not matched by any entry of
+// sites from the top level source, public-keys, cache, compression, images,
+// listing, cors, hotlink, limits, pacing and server.headers.
+func defaultSite() *SiteConfig {
+	if len(config.Source.List) == 0 {
+		return nil
+	}
+	site := &SiteConfig{
+		Source:      config.Source,
+		PublicKeys:  config.PublicKeys,
+		Cache:       config.Cache,
+		Compression: config.Compression,
+		Images:      config.Images,
+		Listing:     config.Listing,
+		CORS:        config.CORS,
+		Hotlink:     config.Hotlink,
+		Limits:      config.Limits,
+		Pacing:      config.Pacing,
+	}
+	site.Headers.CORS = config.Server.Headers.CORS
+	site.Headers.Cache = config.Server.Headers.Cache
+	site.Headers.Upstream = config.Server.Headers.Upstream
+	site.Headers.Rules = config.Server.Headers.Rules
+	return site
+}
+
+func acmeDomains() []string {
+	var domains []string
+	if config.Server.TLS.ACME.Domain != "" {
+		domains = append(domains, config.Server.TLS.ACME.Domain)
+	}
+	for _, site := range config.Sites {
+		if site.TLS.ACME {
+			domains = append(domains, site.Hosts...)
+		}
+	}
+	return domains
+}
+
 func serve(httpServer *http.Server) error {
+	certs := must(loadCertificates(config.Sites))
 	if config.Server.TLS.Key != "" {
-		return httpServer.ListenAndServeTLS(config.Server.TLS.Cert, config.Server.TLS.Key)
+		cert := must(tls.LoadX509KeyPair(config.Server.TLS.Cert, config.Server.TLS.Key))
+		certs.fallback = &cert
 	}
-	if config.Server.TLS.ACME.Domain != "" {
+	if domains := acmeDomains(); len(domains) > 0 {
 		if config.Server.TLS.ACME.CacheDir == "" {
-			config.Server.TLS.ACME.CacheDir = "/var/lib/s3proxy/acme/" + config.Server.TLS.ACME.Domain
+			config.Server.TLS.ACME.CacheDir = "/var/lib/s3proxy/acme/" + domains[0]
 		}
 		throw(os.MkdirAll(config.Server.TLS.ACME.CacheDir, 0700))
-		acme := autocert.Manager{
+		acme := &autocert.Manager{
 			Cache:      autocert.DirCache(config.Server.TLS.ACME.CacheDir),
-			HostPolicy: autocert.HostWhitelist(config.Server.TLS.ACME.Domain),
+			HostPolicy: autocert.HostWhitelist(domains...),
 			Email:      config.Server.TLS.ACME.Email,
 		}
-		ln := must(tls.Listen("tcp", httpServer.Addr, acme.TLSConfig()))
+		if config.Server.TLS.ACME.AcceptTOS {
+			acme.Prompt = autocert.AcceptTOS
+		}
+		certs.acmeHosts = map[string]bool{}
+		for _, domain := range domains {
+			certs.acmeHosts[normalizeHost(domain)] = true
+		}
+		certs.acme = acme.GetCertificate
+		tlsConfig := acme.TLSConfig()
+		tlsConfig.GetCertificate = certs.GetCertificate
+		ln := must(tls.Listen("tcp", httpServer.Addr, tlsConfig))
+		defer Close(ln)
+		return httpServer.Serve(ln)
+	}
+	if certs.fallback != nil || len(certs.byHost) > 0 {
+		ln := must(tls.Listen("tcp", httpServer.Addr, &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}))
 		defer Close(ln)
 		return httpServer.Serve(ln)
 	}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+var _ iCache = (*memCache)(nil)
+var _ invalidator = (*memCache)(nil)
+
+type memEntry struct {
+	key   string
+	value []byte
+	meta  entryMeta
+}
+
+// memCache is a size bounded LRU RAM tier in front of next. Values read from
+// next are promoted when not larger than maxObject, those next refused only
+// when the policy admits them, and evicted values are demoted back to next
+// when it has dropped them meanwhile.
+type memCache struct {
+	next      iCache
+	policy    *Policy
+	max       int64
+	maxObject int64
+	mutex     sync.Mutex
+	size      int64
+	lru       list.List
+	entries   map[string]*list.Element
+}
+
+func NewMemCache(next iCache, max, maxObject int64) iCache {
+	if max <= 0 {
+		return next
+	}
+	if maxObject <= 0 || maxObject > max {
+		maxObject = max
+	}
+	return &memCache{
+		next:      next,
+		max:       max,
+		maxObject: maxObject,
+		entries:   map[string]*list.Element{},
+	}
+}
+
+// Size is the size of the next tier, which keeps most of the values held in
+// RAM too. The RAM tier is reported apart as the memory.size metric.
+func (m *memCache) Size() int64 {
+	return m.next.Size()
+}
+
+// grow changes the size by delta with the mutex held.
+func (m *memCache) grow(delta int64) {
+	m.size += delta
+	metrics.Add("memory.size", delta)
+}
+
+func (m *memCache) Close() error {
+	m.mutex.Lock()
+	m.lru.Init()
+	m.entries = map[string]*list.Element{}
+	m.grow(-m.size)
+	m.mutex.Unlock()
+	return m.next.Close()
+}
+
+func (m *memCache) setPolicy(p *Policy) {
+	m.policy = p
+	if next, ok := m.next.(policied); ok {
+		next.setPolicy(p)
+	}
+}
+
+// lookup drops entries no longer fresh, the next tier revalidates them.
+func (m *memCache) lookup(key string) (*memEntry, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	element, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*memEntry)
+	if m.policy.freshness().state(key, entry.meta.fetched) != fresh {
+		m.lru.Remove(element)
+		delete(m.entries, key)
+		m.grow(-int64(len(entry.value)))
+		return nil, false
+	}
+	m.lru.MoveToFront(element)
+	return entry, true
+}
+
+func (m *memCache) invalidate(key string) {
+	m.mutex.Lock()
+	if element, ok := m.entries[key]; ok {
+		entry := m.lru.Remove(element).(*memEntry)
+		delete(m.entries, key)
+		m.grow(-int64(len(entry.value)))
+	}
+	m.mutex.Unlock()
+	invalidate(m.next, key)
+}
+
+func (m *memCache) promote(key string, value []byte, meta entryMeta) (evicted []*memEntry, ok bool) {
+	size := int64(len(value))
+	if size == 0 || size > m.maxObject {
+		return nil, false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if element, ok := m.entries[key]; ok {
+		entry := element.Value.(*memEntry)
+		m.grow(size - int64(len(entry.value)))
+		entry.value = value
+		entry.meta = meta
+		m.lru.MoveToFront(element)
+	} else {
+		m.entries[key] = m.lru.PushFront(&memEntry{key, value, meta})
+		m.grow(size)
+	}
+	for m.size > m.max {
+		entry := m.lru.Remove(m.lru.Back()).(*memEntry)
+		delete(m.entries, entry.key)
+		m.grow(-int64(len(entry.value)))
+		evicted = append(evicted, entry)
+	}
+	return evicted, true
+}
+
+func (m *memCache) demote(evicted []*memEntry) {
+	next, ok := m.next.(storer)
+	if !ok {
+		return
+	}
+	for _, entry := range evicted {
+		metrics.Add("memory.evict", 1)
+		if !next.contains(entry.key) && next.store(entry.key, entry.value, entry.meta) {
+			metrics.Add("memory.demote", 1)
+		}
+	}
+}
+
+func (m *memCache) Get(ctx context.Context, key string) (result, error) {
+	if entry, ok := m.lookup(key); ok {
+		metrics.Add("memory.hit", 1)
+		return result{CacheUsed: true, ValueCached: true, Tier: "memory", Value: entry.value, meta: entry.meta}, nil
+	}
+	metrics.Add("memory.miss", 1)
+	res, err := m.next.Get(ctx, key)
+	if err != nil {
+		return res, err
+	}
+	if res.File != nil && res.Len() <= m.maxObject {
+		value, err := res.Bytes()
+		res.Close()
+		if err != nil {
+			return result{}, err
+		}
+		res.Value = value
+	}
+	if !res.ValueCached && !m.policy.admits(key, res.size()) {
+		return res, nil
+	}
+	if evicted, ok := m.promote(key, res.Value, res.meta); ok {
+		metrics.Add("memory.promote", 1)
+		res.ValueCached = true
+		m.demote(evicted)
+	}
+	return res, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemCache_Tiers(t *testing.T) {
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	disk := Open(dbPath, 1000, func(ctx context.Context, key, etag string) (object, error) {
+		return object{Value: make([]byte, must(strconv.Atoi(key)))}, nil
+	})
+	cache := NewMemCache(disk, 300, 200)
+	defer func() { _ = cache.Close() }()
+	result := must(cache.Get(context.Background(), "100"))
+	assert(!result.CacheUsed && result.ValueCached && result.Tier == "origin")
+	result = must(cache.Get(context.Background(), "100"))
+	assert(result.CacheUsed && result.Tier == "memory" && result.Header() == "true,true,0")
+	result = must(cache.Get(context.Background(), "250"))
+	assert(!result.CacheUsed && result.Tier == "origin")
+	result = must(cache.Get(context.Background(), "250"))
+	assert(result.CacheUsed && result.Tier == "disk")
+	assert(cache.Size() == 100+250 && cache.(*memCache).size == 100)
+	result = must(cache.Get(context.Background(), "150"))
+	assert(result.Tier == "origin")
+	result = must(cache.Get(context.Background(), "200"))
+	assert(result.Tier == "origin")
+	result = must(cache.Get(context.Background(), "100"))
+	assert(result.CacheUsed && result.Tier == "disk")
+}
+
+func TestMemCache_Demote(t *testing.T) {
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	disk := Open(dbPath, 1000, func(ctx context.Context, key, etag string) (object, error) {
+		return object{Value: make([]byte, 100)}, nil
+	})
+	mem := NewMemCache(disk, 100, 100)
+	defer func() { _ = mem.Close() }()
+	must(mem.Get(context.Background(), "a"))
+	disk.(*cache).index.delete("a")
+	throw(disk.(*cache).storage.delete("a"))
+	assert(!disk.(storer).contains("a"))
+	must(mem.Get(context.Background(), "b"))
+	assert(disk.(storer).contains("a"))
+}
+
+func TestMemCache_Admission(t *testing.T) {
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	defer func() { _ = os.RemoveAll(dbPath) }()
+	disk := Open(dbPath, 1000, func(ctx context.Context, key, etag string) (object, error) {
+		if key == "/big:chunk" {
+			return object{Value: make([]byte, 100), Total: 2e+6}, nil
+		}
+		return object{Value: make([]byte, 100)}, nil
+	})
+	cache := NewMemCache(disk, 1000, 1000)
+	defer func() { _ = cache.Close() }()
+	policy := &Policy{Admission: Admission{Exclude: []string{".m3u8"}}}
+	throw(policy.load())
+	cache.(policied).setPolicy(policy)
+	for i := 0; i < 2; i++ {
+		result := must(cache.Get(context.Background(), "/a.m3u8"))
+		assert(!result.CacheUsed && !result.ValueCached && result.Tier == "origin")
+	}
+	must(cache.Get(context.Background(), "/a.ts"))
+	result := must(cache.Get(context.Background(), "/a.ts"))
+	assert(result.Tier == "memory")
+	policy.Admission.MinKB = 1
+	for i := 0; i < 2; i++ {
+		result = must(cache.Get(context.Background(), "/small.ts"))
+		assert(result.Tier == "origin")
+	}
+	policy.Admission.MinKB, policy.Admission.MaxMB = 0, 1
+	for i := 0; i < 2; i++ {
+		result = must(cache.Get(context.Background(), "/big:chunk"))
+		assert(result.Tier == "origin")
+	}
+}
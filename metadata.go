@@ -0,0 +1,88 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// builtinTypes do not depend on the mime tables of the host.
+var builtinTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mpd":  "application/dash+xml",
+	".vtt":  "text/vtt; charset=utf-8",
+	".mkv":  "video/x-matroska",
+}
+
+func typeByExtension(ext string) string {
+	if t, ok := builtinTypes[strings.ToLower(ext)]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+const amzMetaPrefix = "X-Amz-Meta-"
+
+// originHeader keeps the headers of an origin response stored with objects.
+// Metadata of the S3 encryption client is left out.
+func originHeader(header http.Header) http.Header {
+	kept := http.Header{}
+	for name, values := range header {
+		name = http.CanonicalHeaderKey(name)
+		switch {
+		case name == "Content-Type", name == "Cache-Control", name == "Content-Disposition":
+		case strings.HasPrefix(name, amzMetaPrefix+"X-Amz-"):
+			continue
+		case strings.HasPrefix(name, amzMetaPrefix):
+		default:
+			continue
+		}
+		if len(values) > 0 && values[0] != "" {
+			kept[name] = values
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
+
+// upstreamAllowlist holds canonical header names, a name ending with * is a
+// prefix like X-Amz-Meta-*.
+type upstreamAllowlist []string
+
+func newUpstreamAllowlist(names []string) upstreamAllowlist {
+	allow := make(upstreamAllowlist, len(names))
+	for i, name := range names {
+		allow[i] = http.CanonicalHeaderKey(strings.TrimSuffix(name, "*"))
+		if strings.HasSuffix(name, "*") {
+			allow[i] += "*"
+		}
+	}
+	return allow
+}
+
+func (a upstreamAllowlist) allowed(name string) bool {
+	for _, allowed := range a {
+		if allowed == name || strings.HasSuffix(allowed, "*") && strings.HasPrefix(name, allowed[:len(allowed)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the allowed upstream headers. Generic content types do not
+// replace the type guessed from the extension.
+func (a upstreamAllowlist) apply(dst, upstream http.Header) {
+	for name, values := range upstream {
+		if !a.allowed(name) {
+			continue
+		}
+		if name == "Content-Type" && (values[0] == "binary/octet-stream" || values[0] == "application/octet-stream") && dst.Get(name) != "" {
+			continue
+		}
+		dst[name] = values
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServer_Upstream(t *testing.T) {
+	assert(typeByExtension(".TS") == "video/mp2t")
+	header := originHeader(http.Header{
+		"Content-Type":              {"application/x-mpegURL"},
+		"Cache-Control":             {"max-age=5"},
+		"X-Amz-Meta-Title":          {"Amélie"},
+		"X-Amz-Meta-X-Amz-Key-V2":   {"wrapped"},
+		"Content-Length":            {"10"},
+		"x-amz-meta-lowercase-name": {"1"},
+	})
+	assert(len(header) == 4 && header.Get("X-Amz-Meta-Lowercase-Name") == "1")
+	s := &Server{cacheHeader: "max-age=60", upstream: newUpstreamAllowlist([]string{"content-type", "x-amz-meta-*"})}
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	s.cache = Open(dbPath, 1e+6, func(ctx context.Context, key, etag string) (object, error) {
+		switch key {
+		case "/a/index.m3u8":
+			return object{Value: []byte("#EXTM3U"), Header: header}, nil
+		case "/a/1.ts":
+			return object{Value: []byte("ts"), Header: http.Header{"Content-Type": {"binary/octet-stream"}}}, nil
+		}
+		return object{}, nil
+	})
+	defer func() { _ = s.cache.Close() }()
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/a/index.m3u8", nil))
+		assert(recorder.Header().Get("Content-Type") == "application/x-mpegURL")
+		assert(recorder.Header().Get("X-Amz-Meta-Title") == "Amélie")
+		assert(recorder.Header().Get("Cache-Control") == "max-age=60")
+	}
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/a/1.ts", nil))
+	assert(recorder.Header().Get("Content-Type") == "video/mp2t")
+}
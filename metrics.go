@@ -0,0 +1,19 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// metrics is published by expvar under "s3proxy" and served on
+// server.metrics when configured.
+var metrics = expvar.NewMap("s3proxy")
+
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	go func() {
+		throw(http.ListenAndServe(addr, expvar.Handler()))
+	}()
+}
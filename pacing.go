@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const claimBitrate = "bitrate"
+
+// Pacing delivers matching responses at a multiple of their bitrate after an
+// initial burst. The first rule matching a path applies, a bitrate claim
+// paces responses of any path.
+type Pacing struct {
+	Path string `yaml:"path"`
+	Ext  string `yaml:"ext"`
+	//kbit/s of the media, the bitrate claim takes precedence
+	Bitrate int64 `yaml:"bitrate"`
+	//default 2
+	Multiple float64 `yaml:"multiple"`
+	//media time sent unpaced, default 30s
+	Burst time.Duration `yaml:"burst"`
+}
+
+const pacedChunk = 32 << 10
+
+// validate refuses negative values, zero ones take the defaults.
+func (p *Pacing) validate() error {
+	switch {
+	case p.Bitrate < 0:
+		return errors.New("negative pacing bitrate")
+	case p.Multiple < 0:
+		return errors.New("negative pacing multiple")
+	case p.Burst < 0:
+		return errors.New("negative pacing burst")
+	}
+	return nil
+}
+
+// pacer returns the pacing of filePath, nil when it is not paced.
+func pacer(rules []Pacing, filePath string, claims url.Values) (*Pacing, error) {
+	pacing := &Pacing{}
+	for i := range rules {
+		if matchPath(rules[i].Path, rules[i].Ext, filePath) {
+			*pacing = rules[i]
+			break
+		}
+	}
+	bitrate, err := claimInt(claims, claimBitrate)
+	if err != nil {
+		return nil, err
+	}
+	if bitrate < 0 {
+		return nil, errors.New("negative bitrate")
+	}
+	if bitrate > 0 {
+		pacing.Bitrate = bitrate
+	}
+	if pacing.Bitrate == 0 {
+		return nil, nil
+	}
+	if pacing.Multiple == 0 {
+		pacing.Multiple = 2
+	}
+	if pacing.Burst == 0 {
+		pacing.Burst = 30 * time.Second
+	}
+	return pacing, nil
+}
+
+func (p *Pacing) writer(ctx context.Context, writer http.ResponseWriter, timeout time.Duration) *pacedWriter {
+	bytesPerSecond := float64(p.Bitrate) * 1000 / 8
+	return &pacedWriter{
+		ResponseWriter: writer,
+		ctx:            ctx,
+		timeout:        timeout,
+		rate:           bytesPerSecond * p.Multiple,
+		burst:          int64(bytesPerSecond * p.Burst.Seconds()),
+		start:          time.Now(),
+	}
+}
+
+// extendDeadline gives the next write of a throttled response the write
+// timeout of the server from now, as throttling outlasts it.
+func extendDeadline(writer http.ResponseWriter, timeout time.Duration) {
+	if timeout > 0 {
+		_ = http.NewResponseController(writer).SetWriteDeadline(time.Now().Add(timeout))
+	}
+}
+
+// remaining caps n at the bytes left in r when they are known, as
+// http.ServeContent copies a limited reader, so no wait is spent on bytes
+// that are never sent.
+func remaining(r io.Reader, n int64) int64 {
+	if limited, ok := r.(*io.LimitedReader); ok && limited.N < n {
+		return limited.N
+	}
+	return n
+}
+
+// pacedWriter sleeps between writes once burst bytes are sent, so that the
+// response is sent at rate bytes per second.
+type pacedWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	timeout time.Duration
+	rate    float64
+	burst   int64
+	start   time.Time
+	sent    int64
+}
+
+func (w *pacedWriter) wait(n int64) time.Duration {
+	excess := w.sent + n - w.burst
+	if excess <= 0 {
+		return 0
+	}
+	return time.Until(w.start.Add(time.Duration(float64(excess) / w.rate * float64(time.Second))))
+}
+
+// chunk is the most bytes written at once, a tenth of a second worth at most.
+func (w *pacedWriter) chunk() int64 {
+	chunk := int64(w.rate / 10)
+	if chunk > pacedChunk {
+		return pacedChunk
+	}
+	if chunk < 1 {
+		return 1
+	}
+	return chunk
+}
+
+// pace waits until n more bytes may be sent.
+func (w *pacedWriter) pace(n int64) error {
+	wait := w.wait(n)
+	if wait <= 0 {
+		return nil
+	}
+	if err := sleep(w.ctx, wait); err != nil {
+		return err
+	}
+	extendDeadline(w.ResponseWriter, w.timeout)
+	return nil
+}
+
+func (w *pacedWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if chunk := int(w.chunk()); n > chunk {
+			n = chunk
+		}
+		if err := w.pace(int64(n)); err != nil {
+			return written, err
+		}
+		m, err := w.ResponseWriter.Write(b[:n])
+		written += m
+		w.sent += int64(m)
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// ReadFrom keeps the ReaderFrom of the wrapped writer, e.g. sendfile, for the
+// whole burst and for each paced chunk after it.
+func (w *pacedWriter) ReadFrom(r io.Reader) (int64, error) {
+	var written int64
+	for {
+		n := w.burst - w.sent
+		if n <= 0 {
+			n = w.chunk()
+		}
+		if n = remaining(r, n); n <= 0 {
+			return written, nil
+		}
+		if err := w.pace(n); err != nil {
+			return written, err
+		}
+		m, err := copyN(w.ResponseWriter, r, n)
+		written += m
+		w.sent += m
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+func (w *pacedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *pacedWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	rules := []Pacing{{Ext: ".mp4", Bitrate: 4000, Multiple: 1.5, Burst: 10 * time.Second}}
+	p := must(pacer(rules, "/a.mp4", url.Values{}))
+	assert(p.Bitrate == 4000 && p.Multiple == 1.5)
+	p = must(pacer(rules, "/a.mp4", url.Values{"bitrate": {"800"}}))
+	assert(p.Bitrate == 800 && p.Burst == 10*time.Second)
+	p = must(pacer(rules, "/a.mkv", url.Values{"bitrate": {"800"}}))
+	assert(p.Multiple == 2 && p.Burst == 30*time.Second)
+	assert(must(pacer(rules, "/a.mkv", url.Values{})) == nil)
+	_, err := pacer(rules, "/a.mp4", url.Values{"bitrate": {"fast"}})
+	assert(err != nil)
+	_, err = pacer(rules, "/a.mp4", url.Values{"bitrate": {"-1"}})
+	assert(err != nil)
+	assert(rules[0].validate() == nil)
+	assert((&Pacing{Bitrate: -1}).validate() != nil)
+	assert((&Pacing{Bitrate: 800, Multiple: -2}).validate() != nil)
+	assert((&Pacing{Burst: -time.Second}).validate() != nil)
+}
+
+func TestServer_Pacing(t *testing.T) {
+	//8 kbit/s is 1000 bytes/s, 2000 bytes/s paced after 100ms worth
+	s := &Server{pacing: []Pacing{{Ext: ".mp4", Bitrate: 8, Multiple: 2, Burst: 100 * time.Millisecond}}}
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	s.cache = Open(dbPath, 1e+6, func(ctx context.Context, key, etag string) (object, error) {
+		return object{Value: make([]byte, 500)}, nil
+	})
+	defer func() { _ = s.cache.Close() }()
+	start := time.Now()
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/a.mp4", nil))
+	elapsed := time.Since(start)
+	assert(recorder.Body.Len() == 500)
+	if elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("paced in %s", elapsed)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := (&Pacing{Bitrate: 8, Multiple: 1}).writer(ctx, httptest.NewRecorder(), 0)
+	n, err := w.Write(make([]byte, 100))
+	assert(n == 0 && err == context.Canceled)
+}
+
+// deadlineRecorder records the write deadline set through
+// http.ResponseController.
+type deadlineRecorder struct {
+	*readFromRecorder
+	deadline time.Time
+}
+
+func (r *deadlineRecorder) SetWriteDeadline(deadline time.Time) error {
+	r.deadline = deadline
+	return nil
+}
+
+func TestPacedWriter_ReadFrom(t *testing.T) {
+	recorder := &deadlineRecorder{readFromRecorder: &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}}
+	rules := &ruleWriter{ResponseWriter: recorder, path: "/a.mp4"}
+	w := (&Pacing{Bitrate: 8, Multiple: 2, Burst: 100 * time.Millisecond}).writer(context.Background(), rules, time.Minute)
+	assert(must(w.ReadFrom(io.LimitReader(bytes.NewReader(make([]byte, 100)), 100))) == 100)
+	assert(recorder.readFrom && !recorder.nested && recorder.deadline.IsZero())
+	start := time.Now()
+	assert(must(w.ReadFrom(io.LimitReader(bytes.NewReader(make([]byte, 400)), 400))) == 400)
+	assert(time.Since(start) >= 180*time.Millisecond && recorder.Body.Len() == 500)
+	assert(recorder.deadline.After(start.Add(50*time.Second)) && !recorder.nested)
+}
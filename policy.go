@@ -0,0 +1,145 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy configures how a cache admits, expires, verifies and encrypts its
+// entries. Verify is the fraction of cache hits checked against their stored
+// checksum, 1 checks every hit.
+type Policy struct {
+	Freshness  Freshness  `yaml:"freshness"`
+	Admission  Admission  `yaml:"admission"`
+	Verify     float64    `yaml:"verify"`
+	Encryption Encryption `yaml:"encryption"`
+	keys       *keyring
+	requests   *requestCounter
+}
+
+// load reads the encryption keys, before the policy is set on a cache.
+func (p *Policy) load() (err error) {
+	p.requests = &requestCounter{}
+	p.keys, err = p.Encryption.keyring()
+	return err
+}
+
+// request counts a client request of key, once however many chunks or
+// variants of it are fetched.
+func (p *Policy) request(key string) {
+	if p != nil && p.Admission.Requests > 1 {
+		p.requests.add(key, p.Admission.Window)
+	}
+}
+
+// admits reports whether a fetched value of key is stored, size being the
+// size of the whole object.
+func (p *Policy) admits(key string, size int64) bool {
+	return p == nil || p.Admission.admit(key, size, p.requests)
+}
+
+// policied is implemented by caches applying a Policy.
+type policied interface {
+	setPolicy(p *Policy)
+}
+
+func (p *Policy) freshness() *Freshness {
+	if p == nil {
+		return nil
+	}
+	return &p.Freshness
+}
+
+// Admission decides which fetched objects are stored, MinKB and MaxMB bound
+// the size of whole objects even when cached by chunks. Include and Exclude
+// entries starting with "." match extensions, others match path prefixes.
+// With Requests set a key is stored only once requested that many times
+// within Window.
+type Admission struct {
+	MinKB    int64         `yaml:"min-kb"`
+	MaxMB    int64         `yaml:"max-mb"`
+	Include  []string      `yaml:"include"`
+	Exclude  []string      `yaml:"exclude"`
+	Requests int           `yaml:"requests"`
+	Window   time.Duration `yaml:"window"`
+}
+
+func matchAny(patterns []string, key string) bool {
+	ext := path.Ext(key)
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, ".") {
+			if strings.EqualFold(pattern, ext) {
+				return true
+			}
+		} else if strings.HasPrefix(key, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit is called on every miss of key, with counter holding the requests
+// of keys.
+func (a *Admission) admit(key string, size int64, counter *requestCounter) bool {
+	if a == nil {
+		return true
+	}
+	//chunks and derived entries are admitted as their object
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		key = key[:i]
+	}
+	if a.MinKB > 0 && size < a.MinKB*1e+3 {
+		return false
+	}
+	if a.MaxMB > 0 && size > a.MaxMB*1e+6 {
+		return false
+	}
+	if len(a.Include) > 0 && !matchAny(a.Include, key) {
+		return false
+	}
+	if matchAny(a.Exclude, key) {
+		return false
+	}
+	if a.Requests > 1 && counter.count(key, a.Window) < a.Requests {
+		return false
+	}
+	return true
+}
+
+// maxCountedKeys bounds the keys counted in a window.
+const maxCountedKeys = 1 << 16
+
+// requestCounter counts requests per key in fixed windows, forgetting all
+// counts when a window ends or too many keys are counted.
+type requestCounter struct {
+	mutex  sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+// expire forgets the counts of an ended window, with the mutex held.
+func (r *requestCounter) expire(window time.Duration) {
+	if r.counts == nil || len(r.counts) >= maxCountedKeys || (window > 0 && time.Since(r.start) > window) {
+		r.counts = map[string]int{}
+		r.start = time.Now()
+	}
+}
+
+func (r *requestCounter) add(key string, window time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expire(window)
+	r.counts[key]++
+}
+
+func (r *requestCounter) count(key string, window time.Duration) int {
+	if r == nil {
+		return 0
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expire(window)
+	return r.counts[key]
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	counter := &requestCounter{}
+	a := &Admission{MinKB: 1, MaxMB: 1, Include: []string{".ts", "/films/"}, Exclude: []string{"/films/trailers/"}}
+	assert(a.admit("/live/1.ts", 2000, counter))
+	assert(a.admit("/live/1.TS:4", 2000, counter))
+	assert(a.admit("/films/a/poster.jpg", 2000, counter))
+	assert(!a.admit("/films/trailers/1.ts", 2000, counter))
+	assert(!a.admit("/live/1.m4s", 2000, counter))
+	assert(!a.admit("/live/1.ts", 999, counter))
+	assert(!a.admit("/live/1.ts", 1e+6+1, counter))
+	assert((*Admission)(nil).admit("/any", 1, counter))
+
+	a = &Admission{Requests: 3, Window: time.Hour}
+	for i := 0; i < 2; i++ {
+		counter.add("/key", a.Window)
+		assert(!a.admit("/key", 1, counter))
+		assert(!a.admit("/key:1", 1, counter))
+	}
+	counter.add("/key", a.Window)
+	assert(a.admit("/key:1", 1, counter))
+	assert(!a.admit("/other", 1, counter))
+	assert(!a.admit("/key", 1, nil))
+}
+
+func TestCache_Admission(t *testing.T) {
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	c := Open(dbPath, 1000, func(ctx context.Context, key, etag string) (object, error) {
+		return object{Value: make([]byte, 100)}, nil
+	})
+	defer func() { _ = c.Close() }()
+	policy := &Policy{Admission: Admission{Requests: 2, Window: time.Hour}}
+	throw(policy.load())
+	c.(policied).setPolicy(policy)
+	policy.request("/key")
+	result := must(c.Get(context.Background(), "/key"))
+	assert(!result.ValueCached)
+	result = must(c.Get(context.Background(), "/key"))
+	assert(!result.ValueCached)
+	policy.request("/key")
+	result = must(c.Get(context.Background(), "/key"))
+	assert(!result.CacheUsed && result.ValueCached)
+	result = must(c.Get(context.Background(), "/key"))
+	assert(result.CacheUsed)
+}
+
+func TestChunked_AdmissionSize(t *testing.T) {
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	chunks := &chunked{size: 10}
+	c := Open(dbPath, 1000, chunks.fetcher(func(ctx context.Context, key, etag string, offset, length int64) (object, int64, error) {
+		return object{Value: make([]byte, length)}, 2e+6, nil
+	}))
+	defer func() { _ = c.Close() }()
+	chunks.cache = c
+	c.(policied).setPolicy(&Policy{Admission: Admission{MaxMB: 1}})
+	result := must(c.Get(context.Background(), chunkKey("/film.mp4", 0)))
+	assert(!result.ValueCached)
+}
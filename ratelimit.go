@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the clients of matching paths with token buckets. The
+// first rule matching a path applies.
+type RateLimit struct {
+	Path string `yaml:"path"`
+	Ext  string `yaml:"ext"`
+	//ip (default), token (its signature) or dir
+	Key string `yaml:"key"`
+	//per second, 0 for no limit
+	Requests float64 `yaml:"requests"`
+	//requests, default max(1, requests)
+	Burst float64 `yaml:"burst"`
+	//bytes per second, 0 for no limit
+	Bytes int64 `yaml:"bytes"`
+	//bytes, default one second worth
+	BytesBurst int64 `yaml:"bytes-burst"`
+	//concurrent responses, 0 for no limit
+	Concurrency int `yaml:"concurrency"`
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket and takes n tokens when available, or returns the
+// wait until they are.
+func (b *bucket) take(now time.Time, rate, burst, n float64) (time.Duration, bool) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens < n {
+		return time.Duration((n - b.tokens) / rate * float64(time.Second)), false
+	}
+	b.tokens -= n
+	return 0, true
+}
+
+// full reports whether the bucket has refilled to burst, so that forgetting it
+// does not reset it.
+func (b *bucket) full(now time.Time, rate, burst float64) bool {
+	return b.last.IsZero() || b.tokens+now.Sub(b.last).Seconds()*rate >= burst
+}
+
+type limitState struct {
+	requests, bytes bucket
+	active          int
+}
+
+type limiter struct {
+	*RateLimit
+	mutex  sync.Mutex
+	states map[string]*limitState
+}
+
+func newLimiters(rules []RateLimit) []*limiter {
+	limiters := make([]*limiter, len(rules))
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Burst == 0 {
+			rule.Burst = math.Max(1, rule.Requests)
+		}
+		if rule.BytesBurst == 0 {
+			rule.BytesBurst = rule.Bytes
+		}
+		limiters[i] = &limiter{RateLimit: rule, states: map[string]*limitState{}}
+	}
+	return limiters
+}
+
+// matchLimit returns the limiter of rulePath and the key of the client. dir
+// is the signed directory of listings and archives, which key them by dir.
+func matchLimit(limiters []*limiter, request *http.Request, rulePath, dir string) (*limiter, string) {
+	for _, l := range limiters {
+		if !matchPath(l.Path, l.Ext, rulePath) {
+			continue
+		}
+		switch l.Key {
+		case "token":
+			return l, strings.SplitN(strings.TrimPrefix(request.URL.Path, "/"), "/", 2)[0]
+		case "dir":
+			if dir != "" {
+				return l, dir
+			}
+			return l, path.Dir(rulePath)
+		default:
+			host, _, err := net.SplitHostPort(request.RemoteAddr)
+			if err != nil {
+				host = request.RemoteAddr
+			}
+			return l, host
+		}
+	}
+	return nil, ""
+}
+
+// acquire admits a response of key, which must be released, or returns the
+// wait before retrying.
+func (l *limiter) acquire(key string) (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	state, ok := l.states[key]
+	if !ok {
+		if len(l.states) >= maxCountedKeys && !l.evict(now) {
+			return time.Second, false
+		}
+		state = &limitState{}
+		l.states[key] = state
+	}
+	if l.Concurrency > 0 && state.active >= l.Concurrency {
+		return time.Second, false
+	}
+	//bytes may be owed by a running response
+	if l.Bytes > 0 {
+		if wait, ok := state.bytes.take(now, float64(l.Bytes), float64(l.BytesBurst), 0); !ok {
+			return wait, false
+		}
+	}
+	if l.Requests > 0 {
+		if wait, ok := state.requests.take(now, l.Requests, l.Burst, 1); !ok {
+			return wait, false
+		}
+	}
+	state.active++
+	return 0, true
+}
+
+// evict forgets the idle keys whose buckets are full, which are the same as
+// new ones, and reports whether any was.
+func (l *limiter) evict(now time.Time) bool {
+	evicted := false
+	for k, s := range l.states {
+		if s.active == 0 &&
+			s.requests.full(now, l.Requests, l.Burst) &&
+			s.bytes.full(now, float64(l.Bytes), float64(l.BytesBurst)) {
+			delete(l.states, k)
+			evicted = true
+		}
+	}
+	return evicted
+}
+
+func (l *limiter) release(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if state, ok := l.states[key]; ok {
+		state.active--
+	}
+}
+
+// reserve takes n bytes of key, running into debt, and returns the wait until
+// the debt is paid. A negative n gives bytes back.
+func (l *limiter) reserve(key string, n int64) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	state, ok := l.states[key]
+	if !ok {
+		return 0
+	}
+	rate, burst := float64(l.Bytes), float64(l.BytesBurst)
+	state.bytes.take(time.Now(), rate, burst, 0)
+	state.bytes.tokens = math.Min(burst, state.bytes.tokens-float64(n))
+	if state.bytes.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-state.bytes.tokens / rate * float64(time.Second))
+}
+
+// chunk is the most bytes written at once, small enough to keep the writes of
+// a throttled response steady.
+func (l *limiter) chunk() int64 {
+	if l.BytesBurst > 0 && l.BytesBurst < pacedChunk {
+		return l.BytesBurst
+	}
+	return pacedChunk
+}
+
+func retryAfter(wait time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10)
+}
+
+// copyN is io.CopyN reusing a limited reader r, as http.ServeContent passes,
+// instead of nesting it in another one which sendfile would not unwrap.
+func copyN(dst io.Writer, r io.Reader, n int64) (int64, error) {
+	limited, ok := r.(*io.LimitedReader)
+	if !ok {
+		return io.CopyN(dst, r, n)
+	}
+	chunk := &io.LimitedReader{R: limited.R, N: n}
+	if limited.N < n {
+		chunk.N = limited.N
+	}
+	written, err := io.Copy(dst, chunk)
+	limited.N -= written
+	if err == nil && written < n {
+		err = io.EOF
+	}
+	return written, err
+}
+
+// sleep waits d unless ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// limitWriter blocks before each chunk until the bytes bucket of key allows
+// it, so the responses of a key share its bytes per second.
+type limitWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	timeout time.Duration
+	limiter *limiter
+	key     string
+}
+
+// throttle waits until n more bytes may be sent.
+func (w *limitWriter) throttle(n int64) error {
+	wait := w.limiter.reserve(w.key, n)
+	if wait <= 0 {
+		return nil
+	}
+	if err := sleep(w.ctx, wait); err != nil {
+		return err
+	}
+	extendDeadline(w.ResponseWriter, w.timeout)
+	return nil
+}
+
+func (w *limitWriter) Write(b []byte) (int, error) {
+	if w.limiter.Bytes == 0 {
+		return w.ResponseWriter.Write(b)
+	}
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if chunk := int(w.limiter.chunk()); n > chunk {
+			n = chunk
+		}
+		if err := w.throttle(int64(n)); err != nil {
+			return written, err
+		}
+		m, err := w.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// ReadFrom keeps the ReaderFrom of the wrapped writer, e.g. sendfile, for
+// each chunk.
+func (w *limitWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.limiter.Bytes == 0 {
+		return io.Copy(w.ResponseWriter, r)
+	}
+	var written int64
+	for {
+		n := remaining(r, w.limiter.chunk())
+		if n <= 0 {
+			return written, nil
+		}
+		if err := w.throttle(n); err != nil {
+			return written, err
+		}
+		m, err := copyN(w.ResponseWriter, r, n)
+		written += m
+		if m < n {
+			w.limiter.reserve(w.key, m-n)
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+func (w *limitWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *limitWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServer_RateLimit(t *testing.T) {
+	s := &Server{limits: newLimiters([]RateLimit{
+		{Ext: ".m3u8", Requests: 1, Burst: 2},
+		{Ext: ".mp4", Key: "dir", Bytes: 1000, BytesBurst: 100},
+	})}
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	s.cache = Open(dbPath, 1e+6, func(ctx context.Context, key, etag string) (object, error) {
+		return object{Value: make([]byte, 100)}, nil
+	})
+	defer func() { _ = s.cache.Close() }()
+	get := func(path, remote string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.RemoteAddr = remote
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, request)
+		return recorder
+	}
+	assert(get("/a/index.m3u8", "10.0.0.1:1000").Code == http.StatusOK)
+	assert(get("/b/index.m3u8", "10.0.0.1:1001").Code == http.StatusOK)
+	recorder := get("/a/index.m3u8", "10.0.0.1:1002")
+	assert(recorder.Code == http.StatusTooManyRequests && recorder.Header().Get("Retry-After") == "1")
+	assert(get("/a/index.m3u8", "10.0.0.2:1000").Code == http.StatusOK)
+	assert(get("/a/a.mp4", "10.0.0.1:1000").Code == http.StatusOK)
+	start := time.Now()
+	recorder = get("/a/b.mp4", "10.0.0.2:1000")
+	assert(recorder.Code == http.StatusOK && recorder.Body.Len() == 100)
+	assert(time.Since(start) >= 80*time.Millisecond)
+	s.limits[1].reserve("/a", 2000)
+	recorder = get("/a/c.mp4", "10.0.0.2:1000")
+	assert(recorder.Code == http.StatusTooManyRequests)
+	retry := must(strconv.Atoi(recorder.Header().Get("Retry-After")))
+	assert(retry == 2)
+	assert(get("/b/a.mp4", "10.0.0.2:1000").Code == http.StatusOK)
+	assert(get("/a/a.txt", "10.0.0.1:1000").Code == http.StatusOK)
+}
+
+func TestLimiter_Concurrency(t *testing.T) {
+	l := newLimiters([]RateLimit{{Concurrency: 2}})[0]
+	_, ok := l.acquire("a")
+	assert(ok)
+	_, ok = l.acquire("a")
+	assert(ok)
+	wait, ok := l.acquire("a")
+	assert(!ok && wait == time.Second)
+	_, ok = l.acquire("b")
+	assert(ok)
+	l.release("a")
+	_, ok = l.acquire("a")
+	assert(ok)
+}
+
+func TestServer_RateLimitZip(t *testing.T) {
+	public, key := must2(ed25519.GenerateKey(rand.Reader))
+	s := &Server{publicKeys: []ed25519.PublicKey{public}, limits: newLimiters([]RateLimit{{Path: "/season.zip", Concurrency: 1}})}
+	_, ok := s.limits[0].acquire("192.0.2.1")
+	assert(ok)
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/"+genAuth("season", time.Now().Add(time.Minute), key)+".zip", nil))
+	assert(recorder.Code == http.StatusTooManyRequests)
+}
+
+func TestLimitWriter_Throttle(t *testing.T) {
+	l := newLimiters([]RateLimit{{Bytes: 1000, BytesBurst: 100}})[0]
+	_, ok := l.acquire("a")
+	assert(ok)
+	recorder := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	w := &limitWriter{recorder, context.Background(), 0, l, "a"}
+	start := time.Now()
+	assert(must(w.Write(make([]byte, 150))) == 150)
+	assert(must(w.ReadFrom(io.LimitReader(bytes.NewReader(make([]byte, 300)), 150))) == 150)
+	elapsed := time.Since(start)
+	assert(elapsed >= 180*time.Millisecond && elapsed < time.Second)
+	assert(recorder.Body.Len() == 300 && recorder.readFrom && !recorder.nested)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w.ctx = ctx
+	_, err := w.Write(make([]byte, 100))
+	assert(err == context.Canceled)
+	assert(http.NewResponseController(w).Flush() == nil)
+}
+
+func TestLimiter_Evict(t *testing.T) {
+	l := newLimiters([]RateLimit{{Requests: 1}})[0]
+	for i := 0; i < maxCountedKeys; i++ {
+		_, ok := l.acquire(strconv.Itoa(i))
+		assert(ok)
+		l.release(strconv.Itoa(i))
+	}
+	_, ok := l.acquire("new")
+	assert(!ok)
+	_, ok = l.acquire("0")
+	assert(!ok)
+	l.states["1"].requests.last = time.Now().Add(-time.Second)
+	_, ok = l.acquire("new")
+	assert(ok)
+	_, ok = l.acquire("0")
+	assert(!ok)
+	_, ok = l.states["1"]
+	assert(!ok)
+}
+
+func TestMatchLimit_Dir(t *testing.T) {
+	limiters := newLimiters([]RateLimit{{Key: "dir", Requests: 1}})
+	request := httptest.NewRequest(http.MethodGet, "/token/a/b.zip", nil)
+	_, key := matchLimit(limiters, request, "/a/b.zip", "/a/b")
+	assert(key == "/a/b")
+	_, key = matchLimit(limiters, request, "/a/b/", "/a/b")
+	assert(key == "/a/b")
+	_, key = matchLimit(limiters, request, "/a/b/c.mp4", "")
+	assert(key == "/a/b")
+	_, key = matchLimit(limiters, request, "/a/b.zip", "")
+	assert(key == "/a")
+}
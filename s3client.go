@@ -6,123 +6,306 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"io"
+	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
-	"unicode/utf8"
 )
 
 type Source struct {
-	Bucket string `yaml:"bucket"`
-	Host   string `yaml:"host"`
-	ID     string `yaml:"id"`
-	Key    string `yaml:"key"`
-	Root   string `yaml:"root"`
+	//s3 (default), dir or http
+	Type      string `yaml:"type"`
+	Bucket    string `yaml:"bucket"`
+	Host      string `yaml:"host"`
+	Root      string `yaml:"root"`
+	Region    string `yaml:"region"`
+	PathStyle *bool  `yaml:"path-style"`
+	Insecure  bool   `yaml:"insecure"`
+	//static credentials, key-file and id-file are read from disk
+	ID      string `yaml:"id"`
+	Key     string `yaml:"key"`
+	IDFile  string `yaml:"id-file"`
+	KeyFile string `yaml:"key-file"`
+	//shared config profile
+	Profile string `yaml:"profile"`
+	//web identity
+	RoleARN              string `yaml:"role-arn"`
+	WebIdentityTokenFile string `yaml:"web-identity-token-file"`
+	//extra request headers of http sources
+	Headers map[string]string `yaml:"headers"`
+	//compare downloads with an ETag holding their MD5
+	VerifyETag bool `yaml:"verify-etag"`
+	//customer key of SSE-C objects
+	SSECustomerKey *KeySource `yaml:"sse-c-key"`
+	//master key of client-side (envelope) encrypted objects
+	EnvelopeKey *KeySource `yaml:"envelope-key"`
 }
-type client struct {
-	api    s3iface.S3API
-	bucket string
-	root   string
-}
-type S3Client struct {
-	clients        []client
-	defaultTimeout time.Duration
+
+func readSecret(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
 }
 
-func Connect(testSources bool, defaultTimeout time.Duration, list ...Source) (*S3Client, error) {
-	var clients []client
-	for _, source := range list {
-		ses, err := session.NewSession(&aws.Config{
-			Credentials:      credentials.NewStaticCredentials(source.ID, source.Key, ""),
-			Endpoint:         aws.String(source.Host),
-			Region:           aws.String("us-east-1"),
-			DisableSSL:       aws.Bool(false),
-			S3ForcePathStyle: aws.Bool(true),
-		})
-		if err != nil {
+func (source *Source) staticCredentials() (*credentials.Credentials, error) {
+	id, key := source.ID, source.Key
+	var err error
+	if source.IDFile != "" {
+		if id, err = readSecret(source.IDFile); err != nil {
 			return nil, err
 		}
-		cli := client{
-			s3.New(ses),
-			source.Bucket,
-			source.Root,
-		}
-		if testSources {
-			if err := cli.Test(context.Background(), time.Second*5); err != nil {
-				return nil, err
-			}
+	}
+	if source.KeyFile != "" {
+		if key, err = readSecret(source.KeyFile); err != nil {
+			return nil, err
 		}
-		clients = append(clients, cli)
 	}
-	if len(clients) == 0 {
-		panic(errors.New("no source"))
+	if id == "" && key == "" {
+		return nil, nil
 	}
-	return &S3Client{clients, defaultTimeout}, nil
+	return credentials.NewStaticCredentials(id, key, ""), nil
 }
 
-func (s *S3Client) Download(ctx context.Context, key string) ([]byte, error) {
-	//TODO fetch once
-	switch key {
-	case "", " ", "/", ".", "./", "//":
-		return nil, errors.New("invalid key")
+// session resolves credentials in order: static id/key (or their files), web
+// identity, then the SDK default chain (environment, shared config profile,
+// web identity environment, container endpoint and EC2 role).
+func (source *Source) session() (*session.Session, error) {
+	cfg := aws.Config{
+		S3ForcePathStyle: aws.Bool(source.PathStyle == nil || *source.PathStyle),
+		DisableSSL:       aws.Bool(source.Insecure || strings.HasPrefix(source.Host, "http://")),
+	}
+	if source.Host != "" {
+		cfg.Endpoint = aws.String(source.Host)
 	}
-	if !utf8.ValidString(key) {
-		return nil, errors.New("non-utf8 key")
+	if source.Region != "" {
+		cfg.Region = aws.String(source.Region)
 	}
-	return s.downloadAny(ctx, key)
+	static, err := source.staticCredentials()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Credentials = static
+	ses, err := session.NewSessionWithOptions(session.Options{
+		Config:            cfg,
+		Profile:           source.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(ses.Config.Region) == "" {
+		ses.Config.Region = aws.String("us-east-1")
+	}
+	if static == nil && source.RoleARN != "" && source.WebIdentityTokenFile != "" {
+		ses.Config.Credentials = stscreds.NewWebIdentityCredentials(ses, source.RoleARN, "s3proxy", source.WebIdentityTokenFile)
+	}
+	return ses, nil
 }
 
-func (s *S3Client) downloadAny(ctx context.Context, path string) ([]byte, error) {
-	var last error
-	for _, client := range s.clients {
-		var content []byte
-		content, last = client.DownloadTimeout(ctx, path, s.defaultTimeout)
-		if len(content) > 0 {
-			return content, nil
+var _ Backend = (*client)(nil)
+
+type client struct {
+	api        s3iface.S3API
+	bucket     string
+	root       string
+	verifyETag bool
+	sseKey     *string
+	envelope   *envelope
+}
+
+func newS3Backend(source *Source) (*client, error) {
+	ses, err := source.session()
+	if err != nil {
+		return nil, err
+	}
+	c := &client{
+		api:        s3.New(ses),
+		bucket:     source.Bucket,
+		root:       source.Root,
+		verifyETag: source.VerifyETag,
+	}
+	if source.SSECustomerKey != nil {
+		key, err := source.SSECustomerKey.load()
+		if err != nil {
+			return nil, err
+		}
+		c.sseKey = aws.String(string(key))
+		//etags of SSE-C objects are not their MD5
+		c.verifyETag = false
+	}
+	if source.EnvelopeKey != nil {
+		if c.envelope, err = newEnvelope(source.EnvelopeKey); err != nil {
+			return nil, err
 		}
 	}
-	return nil, last
+	return c, nil
 }
 
-func (client *client) download(ctx context.Context, path string) ([]byte, error) {
-	rootPath := path
+func (client *client) key(path string) string {
 	switch client.root {
 	case "", "/":
+		return path
 	default:
-		rootPath = filepath.Join(client.root, path)
+		return filepath.Join(client.root, path)
 	}
-	response, err := client.api.GetObjectWithContext(ctx, &s3.GetObjectInput{
-		Bucket: &client.bucket,
-		Key:    aws.String(rootPath),
-	})
+}
+
+func (client *client) get(ctx context.Context, input *s3.GetObjectInput, etag string) (*s3.GetObjectOutput, object, error) {
+	if etag != "" {
+		input.IfNoneMatch = aws.String(etag)
+	}
+	if client.sseKey != nil {
+		//the SDK fills in the key MD5
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = client.sseKey
+	}
+	response, err := client.api.GetObjectWithContext(ctx, input)
 	if err != nil {
 		var awsErr awserr.Error
-		if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
-			return nil, nil
+		if errors.As(err, &awsErr) {
+			switch awsErr.Code() {
+			case s3.ErrCodeNoSuchKey, "InvalidRange":
+				return nil, object{}, nil
+			case "NotModified":
+				return nil, object{ETag: etag}, errNotModified
+			}
 		}
-		return nil, err
+		return nil, object{}, err
 	}
 	defer Close(response.Body)
 	content, err := io.ReadAll(response.Body)
 	if err != nil {
-		return nil, errors.New("could not download: " + err.Error())
+		return nil, object{}, errors.New("could not download: " + err.Error())
 	}
 	if int64(len(content)) != *response.ContentLength {
-		return nil, errors.New("failed to read body")
+		return nil, object{}, errors.New("failed to read body")
+	}
+	return response, object{Value: content, ETag: aws.StringValue(response.ETag), Header: s3Header(response)}, nil
+}
+
+func s3Header(response *s3.GetObjectOutput) http.Header {
+	header := http.Header{}
+	for name, value := range map[string]*string{
+		"Content-Type":        response.ContentType,
+		"Cache-Control":       response.CacheControl,
+		"Content-Disposition": response.ContentDisposition,
+	} {
+		if value != nil {
+			header.Set(name, *value)
+		}
+	}
+	for name, value := range response.Metadata {
+		if value != nil {
+			header.Set(amzMetaPrefix+name, *value)
+		}
+	}
+	return originHeader(header)
+}
+
+// verify compares a whole object with the checksums S3 returned for it.
+func (client *client) verify(response *s3.GetObjectOutput, content []byte) error {
+	for _, digest := range []struct {
+		algorithm string
+		value     *string
+	}{
+		{"crc32c", response.ChecksumCRC32C},
+		{"crc32", response.ChecksumCRC32},
+		{"sha256", response.ChecksumSHA256},
+		{"sha1", response.ChecksumSHA1},
+	} {
+		if err := verifyDigest(digest.algorithm, aws.StringValue(digest.value), content); err != nil {
+			return err
+		}
+	}
+	if client.verifyETag {
+		return verifyETag(aws.StringValue(response.ETag), content)
+	}
+	return nil
+}
+
+func (client *client) Download(ctx context.Context, path, etag string) (object, error) {
+	response, obj, err := client.get(ctx, &s3.GetObjectInput{
+		Bucket:       &client.bucket,
+		Key:          aws.String(client.key(path)),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	}, etag)
+	if err != nil || response == nil {
+		return obj, err
+	}
+	if err := client.verify(response, obj.Value); err != nil {
+		return object{}, err
+	}
+	if client.envelope != nil {
+		if obj.Value, err = client.envelope.open(response.Metadata, obj.Value); err != nil {
+			return object{}, err
+		}
+	}
+	return obj, nil
+}
+
+var errEnvelopeRange = errors.New("ranges of envelope encrypted objects")
+
+// DownloadRange fails for envelope encrypted sources, GCM authenticates the
+// complete ciphertext so they are never cached by chunks.
+func (client *client) DownloadRange(ctx context.Context, path, etag string, offset, length int64) (object, int64, error) {
+	if client.envelope != nil {
+		return object{}, 0, errEnvelopeRange
+	}
+	response, obj, err := client.get(ctx, &s3.GetObjectInput{
+		Bucket: &client.bucket,
+		Key:    aws.String(client.key(path)),
+		Range:  aws.String(httpRange(offset, length)),
+	}, etag)
+	if err != nil || response == nil {
+		return obj, 0, err
+	}
+	if response.ContentRange == nil {
+		return obj, int64(len(obj.Value)), nil
+	}
+	total, err := parseContentRange(*response.ContentRange)
+	if err != nil {
+		return object{}, 0, err
 	}
-	return content, nil
+	return obj, total, nil
 }
-func (client *client) DownloadTimeout(ctx context.Context, path string, timeout time.Duration) ([]byte, error) {
-	if timeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, timeout)
-		defer cancel()
+
+var _ lister = (*client)(nil)
+
+func (client *client) List(ctx context.Context, dir string, recursive bool) ([]listEntry, error) {
+	//keys of objects are stored without the leading slash of paths
+	prefix := strings.TrimPrefix(client.key(dir), "/") + "/"
+	input := &s3.ListObjectsV2Input{
+		Bucket: &client.bucket,
+		Prefix: aws.String(prefix),
 	}
-	return client.download(ctx, path)
+	if !recursive {
+		input.Delimiter = aws.String("/")
+	}
+	var entries []listEntry
+	err := client.api.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, p := range page.CommonPrefixes {
+			if name := strings.TrimPrefix(aws.StringValue(p.Prefix), prefix); listable(dir, name) {
+				entries = append(entries, listEntry{Name: name})
+			}
+		}
+		for _, o := range page.Contents {
+			if name := strings.TrimPrefix(aws.StringValue(o.Key), prefix); listable(dir, name) {
+				entries = append(entries, listEntry{Name: name, Size: aws.Int64Value(o.Size), Modified: aws.TimeValue(o.LastModified)})
+			}
+		}
+		return len(entries) <= maxListEntries
+	})
+	return entries, err
 }
+
 func (client *client) Test(ctx context.Context, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
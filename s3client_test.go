@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSource_Session(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	throw(os.MkdirAll(dir, 0700))
+	defer func() { _ = os.RemoveAll(dir) }()
+	throw(os.WriteFile(filepath.Join(dir, "id"), []byte("ID\n"), 0600))
+	throw(os.WriteFile(filepath.Join(dir, "key"), []byte("KEY\n"), 0600))
+	source := Source{
+		Host:      "http://127.0.0.1:9000",
+		PathStyle: aws.Bool(false),
+		IDFile:    filepath.Join(dir, "id"),
+		KeyFile:   filepath.Join(dir, "key"),
+	}
+	ses := must(source.session())
+	assert(aws.BoolValue(ses.Config.DisableSSL))
+	assert(!aws.BoolValue(ses.Config.S3ForcePathStyle))
+	assert(aws.StringValue(ses.Config.Region) != "")
+	value := must(ses.Config.Credentials.Get())
+	if value.AccessKeyID != "ID" || value.SecretAccessKey != "KEY" {
+		t.Fatalf("unexpected credentials %s %s", value.AccessKeyID, value.SecretAccessKey)
+	}
+	source = Source{Region: "eu-west-1", ID: "a", Key: "b"}
+	ses = must(source.session())
+	assert(!aws.BoolValue(ses.Config.DisableSSL))
+	assert(aws.BoolValue(ses.Config.S3ForcePathStyle))
+	assert(aws.StringValue(ses.Config.Region) == "eu-west-1")
+}
+
+type encryptedS3 struct {
+	s3iface.S3API
+	input *s3.GetObjectInput
+	body  []byte
+	meta  map[string]*string
+}
+
+func (e *encryptedS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	e.input = input
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: aws.Int64(int64(len(e.body))),
+		Metadata:      e.meta,
+	}, nil
+}
+
+func TestClient_Encrypted(t *testing.T) {
+	master, dataKey, iv := make([]byte, 32), make([]byte, 32), make([]byte, 12)
+	must(rand.Read(master))
+	must(rand.Read(dataKey))
+	must(rand.Read(iv))
+	wrapper := must(newGCM(master))
+	nonce := make([]byte, wrapper.NonceSize())
+	must(rand.Read(nonce))
+	wrapped := wrapper.Seal(nonce, nonce, dataKey, []byte(envelopeContentAlg))
+	api := &encryptedS3{
+		body: must(newGCM(dataKey)).Seal(nil, iv, []byte("plain text"), nil),
+		meta: map[string]*string{
+			"X-Amz-Key-V2":   aws.String(base64.StdEncoding.EncodeToString(wrapped)),
+			"X-Amz-Iv":       aws.String(base64.StdEncoding.EncodeToString(iv)),
+			"X-Amz-Wrap-Alg": aws.String(envelopeWrapAlg),
+			"X-Amz-Cek-Alg":  aws.String(envelopeContentAlg),
+		},
+	}
+	c := &client{api: api, bucket: "b", sseKey: aws.String(string(master)), envelope: &envelope{wrapper}}
+	obj := must(c.Download(context.Background(), "/a", ""))
+	assert(string(obj.Value) == "plain text")
+	assert(obj.Header == nil)
+	assert(aws.StringValue(api.input.SSECustomerAlgorithm) == "AES256")
+	assert(aws.StringValue(api.input.SSECustomerKey) == string(master))
+	_, _, err := c.DownloadRange(context.Background(), "/a", "", 6, 10)
+	assert(err == errEnvelopeRange)
+	api.meta = nil
+	api.body = []byte("not encrypted")
+	assert(string(must(c.Download(context.Background(), "/a", "")).Value) == "not encrypted")
+	api.meta = map[string]*string{"X-Amz-Key-V2": aws.String("AAAA"), "X-Amz-Wrap-Alg": aws.String("kms")}
+	_, err = c.Download(context.Background(), "/a", "")
+	assert(err != nil)
+}
@@ -3,19 +3,33 @@ package main
 import (
 	"context"
 	"crypto/ed25519"
-	"mime"
+	"io"
 	"net/http"
+	"net/url"
 	"path/filepath"
-	"strconv"
+	"strings"
 	"time"
 )
 
 var _ http.Handler = (*Server)(nil)
 
 type Server struct {
-	publicKeys              []ed25519.PublicKey
-	cache                   iCache
-	corsHeader, cacheHeader string
+	publicKeys   []ed25519.PublicKey
+	origin       *Origin
+	lists        *listCache
+	cache        iCache
+	policy       *Policy
+	chunks       *chunked
+	cors         *corsPolicy
+	cacheHeader  string
+	compression  *Compression
+	images       Images
+	upstream     upstreamAllowlist
+	headerRules  []HeaderRule
+	hotlink      []HotlinkRule
+	limits       []*limiter
+	pacing       []Pacing
+	writeTimeout time.Duration
 }
 
 func (s *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
@@ -23,47 +37,201 @@ func (s *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 		http.Error(writer, "too large path", http.StatusBadRequest)
 		return
 	}
+	var rules *ruleWriter
+	if len(s.headerRules) > 0 {
+		rules = &ruleWriter{ResponseWriter: writer, rules: s.headerRules, path: request.URL.Path}
+		writer = rules
+	}
 	writer.Header().Set("X-Robots-Tag", "noindex, nofollow")
 	_ = request.Body.Close()
-	ctx, cancel := context.WithTimeout(request.Context(), time.Second*10)
+	streamCtx := request.Context()
+	ctx, cancel := context.WithTimeout(streamCtx, time.Second*10)
 	defer cancel()
 	request = request.WithContext(ctx)
-	writer.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET")
-	writer.Header().Set("Access-Control-Allow-Origin", s.corsHeader)
-	switch request.Method {
-	case http.MethodGet:
-	case http.MethodOptions:
-		writer.WriteHeader(http.StatusNoContent)
+	if s.cors.handle(writer, request) {
 		return
-	default:
+	}
+	if request.Method != http.MethodGet {
 		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	writer.Header().Set("Cache-Control", s.cacheHeader)
-	filePath, err := Auth(request.URL.Path, s.publicKeys...)
+	filePath, dir, claims, err := s.authorize(request)
 	if err != nil {
 		http.Error(writer, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	if !filepath.IsAbs(filePath) {
+	if dir == "" && !filepath.IsAbs(filePath) {
 		http.Error(writer, "relative file path", http.StatusBadRequest)
 		return
 	}
-	res, err := s.cache.Get(request.Context(), filePath)
+	//path rules match listings as dir/ and archives as dir.zip
+	rulePath := filePath
+	if dir != "" {
+		rulePath = dir + ".zip"
+		if strings.HasSuffix(request.URL.Path, "/") {
+			rulePath = dir + "/"
+		}
+	}
+	if rules != nil {
+		rules.path = rulePath
+	}
+	placeholder, done := s.checkHotlink(writer, request, rulePath)
+	if done {
+		return
+	}
+	if limit, client := matchLimit(s.limits, request, rulePath, dir); limit != nil {
+		if wait, ok := limit.acquire(client); !ok {
+			metrics.Add("limit.rejected", 1)
+			writer.Header().Set("Retry-After", retryAfter(wait))
+			http.Error(writer, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		defer limit.release(client)
+		writer = &limitWriter{writer, streamCtx, s.writeTimeout, limit, client}
+	}
+	if placeholder != "" {
+		filePath, dir = placeholder, ""
+	}
+	switch {
+	case dir != "" && strings.HasSuffix(rulePath, "/"):
+		s.serveListing(writer, request, dir)
+		return
+	case dir != "":
+		s.serveZip(writer, request, streamCtx, dir, claims)
+		return
+	}
+	pacing, err := pacer(s.pacing, filePath, claims)
+	if err != nil {
+		http.Error(writer, "invalid bitrate", http.StatusBadRequest)
+		return
+	}
+	if pacing != nil {
+		metrics.Add("pacing.paced", 1)
+		writer = pacing.writer(streamCtx, writer, s.writeTimeout)
+	}
+	t, err := s.images.parseTransform(claims, filepath.Ext(filePath))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dispositionHeader, err := disposition(claims)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.policy.request(filePath)
+	key, ext := filePath, filepath.Ext(filePath)
+	if t != nil {
+		key, ext = t.key(filePath), "."+t.format
+	}
+	res, content, err := s.content(request.Context(), streamCtx, key)
+	if err == nil && content == nil && filepath.Ext(filePath) == ".vtt" {
+		shift, shiftErr := claimInt(claims, claimShift)
+		if shiftErr != nil {
+			http.Error(writer, "invalid shift", http.StatusBadRequest)
+			return
+		}
+		key = srtKey(filePath, shift)
+		res, content, err = s.content(request.Context(), streamCtx, key)
+	}
 	if err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer res.Close()
 	writer.Header().Add("X-Cache", res.Header())
-	if len(res.Value) == 0 {
+	writer.Header().Set("X-Cache-Tier", res.Tier)
+	if content == nil {
+		//without auth a missing archive is built from its directory
+		if len(s.publicKeys) == 0 && s.origin != nil && filepath.Ext(filePath) == ".zip" {
+			s.serveZip(writer, request, streamCtx, strings.TrimSuffix(filePath, ".zip"), claims)
+			return
+		}
 		http.NotFound(writer, request)
 		return
 	}
-	if ext := filepath.Ext(filePath); ext != "" {
-		if mimeType := mime.TypeByExtension(ext); mimeType != "" {
-			writer.Header().Add("Content-Type", mimeType)
+	if mimeType := typeByExtension(ext); mimeType != "" {
+		writer.Header().Set("Content-Type", mimeType)
+	}
+	//derived variants and placeholders have headers of their own
+	if key == filePath && placeholder == "" {
+		s.upstream.apply(writer.Header(), res.meta.upstream())
+	}
+	mimeType := writer.Header().Get("Content-Type")
+	if dispositionHeader != "" {
+		writer.Header().Set("Content-Disposition", dispositionHeader)
+	}
+	if s.compression.compressible(mimeType) {
+		writer.Header().Add("Vary", "Accept-Encoding")
+		if request.Header.Get("Range") == "" && acceptsGzip(request.Header.Get("Accept-Encoding")) && s.compress(writer, request, key, content) {
+			return
+		}
+	}
+	http.ServeContent(writer, request, filePath, time.Time{}, content)
+}
+
+// authorize returns the path of the requested object, or the directory of a
+// listing, for paths ending with a slash, or of an archive.
+func (s *Server) authorize(request *http.Request) (filePath, dir string, claims url.Values, err error) {
+	path, query := request.URL.Path, request.URL.Query()
+	if s.lists != nil && strings.HasSuffix(path, "/") {
+		dir, claims, err = AuthDir(path, query, s.publicKeys...)
+		return "", dir, claims, err
+	}
+	filePath, claims, err = AuthClaims(path, query, s.publicKeys...)
+	if err != nil && strings.HasSuffix(path, ".zip") {
+		if dir, dirClaims, dirErr := AuthDir(strings.TrimSuffix(path, ".zip"), query, s.publicKeys...); dirErr == nil {
+			return "", dir, dirClaims, nil
+		}
+	}
+	return filePath, "", claims, err
+}
+
+// content returns a nil reader when the object does not exist. Chunks after
+// the first are fetched with streamCtx while the response is written. Derived
+// keys, e.g. compressed variants, are never chunked.
+func (s *Server) content(ctx, streamCtx context.Context, filePath string) (result, io.ReadSeeker, error) {
+	if s.chunks != nil && !strings.Contains(filePath, ":") {
+		res, reader, err := s.chunks.open(ctx, filePath)
+		if err != nil || reader == nil {
+			return res, nil, err
 		}
+		reader.ctx = streamCtx
+		return res, reader, nil
+	}
+	res, err := s.cache.Get(ctx, filePath)
+	if err != nil || res.Len() == 0 {
+		res.Close()
+		return res, nil, err
+	}
+	return res, res.Reader(), nil
+}
+
+// streamWriter writes a response of unknown length, which fails with a 500
+// until its body is started and is aborted afterwards. With a timeout each
+// write gets it again, for streams outlasting the write timeout.
+type streamWriter struct {
+	http.ResponseWriter
+	timeout time.Duration
+	started bool
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.started = true
+	extendDeadline(w.ResponseWriter, w.timeout)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *streamWriter) abort(err error) {
+	if w.started {
+		panic(http.ErrAbortHandler)
 	}
-	writer.Header().Set("Content-Length", strconv.FormatInt(int64(len(res.Value)), 10))
-	_, _ = writer.Write(res.Value)
+	w.Header().Del("Content-Encoding")
+	w.Header().Del("Content-Disposition")
+	http.Error(w.ResponseWriter, err.Error(), http.StatusInternalServerError)
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type SiteConfig struct {
+	Hosts []string `yaml:"hosts"`
+	TLS   struct {
+		Key  string `yaml:"key"`
+		Cert string `yaml:"cert"`
+		ACME bool   `yaml:"acme"`
+	} `yaml:"tls"`
+	Headers struct {
+		CORS  string `yaml:"cors"`
+		Cache string `yaml:"cache"`
+		//origin headers passed through, e.g. Content-Type or X-Amz-Meta-*
+		Upstream []string     `yaml:"upstream"`
+		Rules    []HeaderRule `yaml:"rules"`
+	} `yaml:"headers"`
+	Source      SiteSource    `yaml:"source"`
+	PublicKeys  []string      `yaml:"public-keys"`
+	Cache       SiteCache     `yaml:"cache"`
+	Compression Compression   `yaml:"compression"`
+	Images      Images        `yaml:"images"`
+	Listing     Listing       `yaml:"listing"`
+	CORS        CORS          `yaml:"cors"`
+	Hotlink     []HotlinkRule `yaml:"hotlink"`
+	Limits      []RateLimit   `yaml:"limits"`
+	Pacing      []Pacing      `yaml:"pacing"`
+}
+type SiteSource struct {
+	List    []Source      `yaml:"list"`
+	Test    bool          `yaml:"test,omitempty"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+type SiteCache struct {
+	SizeGB uint16 `yaml:"size"`
+	Dir    string `yaml:"dir"`
+	//leveldb (default) or files
+	Backend string `yaml:"backend"`
+	//several directories, e.g. one per disk, used instead of dir and size
+	Dirs []CacheDir `yaml:"dirs"`
+	//cache objects as chunks of this size in MB fetched with ranged requests
+	ChunkMB uint16 `yaml:"chunk"`
+	Policy  `yaml:",inline"`
+	//optional RAM tier in front of the disk cache
+	Memory struct {
+		SizeMB      uint32 `yaml:"size"`
+		MaxObjectKB uint32 `yaml:"max-object"`
+	} `yaml:"memory"`
+}
+
+func (site *SiteConfig) name() string {
+	if len(site.Hosts) == 0 {
+		return "default"
+	}
+	return site.Hosts[0]
+}
+
+func newServer(site *SiteConfig) *Server {
+	if len(site.PublicKeys) == 0 {
+		fmt.Println(site.name(), "NO AUTH")
+	}
+	if site.Cache.SizeGB == 0 && len(site.Cache.Dirs) == 0 {
+		fmt.Println(site.name(), "NO CACHE")
+	}
+	server := &Server{
+		publicKeys:   mustParsePublicKeys(site.PublicKeys...),
+		cors:         newCORS(site.CORS, site.Headers.CORS),
+		cacheHeader:  site.Headers.Cache,
+		compression:  site.Compression.enabled(),
+		images:       site.Images,
+		upstream:     newUpstreamAllowlist(site.Headers.Upstream),
+		headerRules:  site.Headers.Rules,
+		hotlink:      site.Hotlink,
+		limits:       newLimiters(site.Limits),
+		pacing:       site.Pacing,
+		lists:        site.Listing.cache(),
+		writeTimeout: config.Server.Timeouts.Write,
+	}
+	for _, source := range site.Source.List {
+		//each chunk would download and decrypt the whole object
+		if source.EnvelopeKey != nil && site.Cache.ChunkMB > 0 {
+			panic(errors.New("chunk with envelope encrypted source " + source.Host))
+		}
+	}
+	origin := must(Connect(site.Source.Test, site.Source.Timeout, site.Source.List...))
+	missing := OnMissing(origin.Download)
+	var chunks *chunked
+	if site.Cache.ChunkMB > 0 {
+		chunks = &chunked{size: int64(site.Cache.ChunkMB) * 1e+6}
+		missing = chunks.fetcher(origin.DownloadRange)
+	}
+	missing = server.srtFetcher(missing)
+	missing = server.imageFetcher(missing)
+	if server.compression != nil && server.compression.Cache {
+		missing = server.gzipFetcher(missing)
+	}
+	var cache iCache
+	if len(site.Cache.Dirs) > 0 {
+		cache = OpenRing(site.Cache.Backend, site.Cache.Dirs, missing)
+	} else {
+		cache = OpenCache(site.Cache.Backend, site.Cache.Dir, int64(site.Cache.SizeGB)*1e+9, missing)
+	}
+	cache = NewMemCache(cache, int64(site.Cache.Memory.SizeMB)*1e+6, int64(site.Cache.Memory.MaxObjectKB)*1e+3)
+	throw(site.Cache.Policy.load())
+	if site.Cache.Policy.keys != nil && chunks == nil {
+		panic(errors.New("cache encryption without chunk"))
+	}
+	for i := range site.Hotlink {
+		throw(site.Hotlink[i].validate())
+	}
+	for i := range site.Pacing {
+		throw(site.Pacing[i].validate())
+	}
+	if p, ok := cache.(policied); ok {
+		p.setPolicy(&site.Cache.Policy)
+	}
+	if chunks != nil {
+		chunks.cache = cache
+	}
+	server.origin, server.cache, server.policy, server.chunks = origin, cache, &site.Cache.Policy, chunks
+	return server
+}
+
+var _ http.Handler = (*Router)(nil)
+
+type Router struct {
+	sites    map[string]*Server
+	fallback *Server
+	servers  []*Server
+}
+
+func NewRouter(fallback *SiteConfig, sites ...SiteConfig) *Router {
+	router := &Router{sites: map[string]*Server{}}
+	for i := range sites {
+		if len(sites[i].Hosts) == 0 {
+			panic(errors.New("site without hosts"))
+		}
+		server := newServer(&sites[i])
+		for _, host := range sites[i].Hosts {
+			host = normalizeHost(host)
+			if _, exists := router.sites[host]; exists {
+				panic(errors.New("duplicate site host " + host))
+			}
+			router.sites[host] = server
+		}
+		router.servers = append(router.servers, server)
+	}
+	if fallback != nil {
+		router.fallback = newServer(fallback)
+		router.servers = append(router.servers, router.fallback)
+	}
+	if len(router.servers) == 0 {
+		panic(errors.New("no site"))
+	}
+	return router
+}
+
+func (r *Router) Close() error {
+	for _, server := range r.servers {
+		Close(server.cache)
+	}
+	return nil
+}
+
+func (r *Router) site(host string) *Server {
+	if server, ok := r.sites[normalizeHost(host)]; ok {
+		return server
+	}
+	return r.fallback
+}
+
+func (r *Router) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	server := r.site(request.Host)
+	if server == nil {
+		http.Error(writer, "unknown host", http.StatusMisdirectedRequest)
+		return
+	}
+	server.ServeHTTP(writer, request)
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+type certificates struct {
+	byHost   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	//hosts whose certificate is issued by acme
+	acmeHosts map[string]bool
+	acme      func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+func loadCertificates(sites []SiteConfig) (*certificates, error) {
+	certs := &certificates{byHost: map[string]*tls.Certificate{}}
+	for _, site := range sites {
+		if site.TLS.Key == "" {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(site.TLS.Cert, site.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range site.Hosts {
+			certs.byHost[normalizeHost(host)] = &cert
+		}
+	}
+	return certs, nil
+}
+
+func (c *certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert, ok := c.byHost[normalizeHost(hello.ServerName)]; ok {
+		return cert, nil
+	}
+	if c.acme != nil && c.acmeHosts[normalizeHost(hello.ServerName)] {
+		return c.acme(hello)
+	}
+	if c.fallback != nil {
+		return c.fallback, nil
+	}
+	return nil, errors.New("no certificate for " + hello.ServerName)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestRouter_Site(t *testing.T) {
+	brand1, brand2, fallback := &Server{}, &Server{}, &Server{}
+	router := &Router{
+		sites: map[string]*Server{
+			"brand1.example": brand1,
+			"brand2.example": brand2,
+		},
+		fallback: fallback,
+	}
+	assert(router.site("brand1.example") == brand1)
+	assert(router.site("BRAND1.example:443") == brand1)
+	assert(router.site("brand2.example.") == brand2)
+	assert(router.site("other.example") == fallback)
+	router.fallback = nil
+	assert(router.site("other.example") == nil)
+}
+
+func TestNormalizeHost(t *testing.T) {
+	for host, expected := range map[string]string{
+		"Example.COM":       "example.com",
+		"example.com:8080":  "example.com",
+		"example.com.":      "example.com",
+		"[::1]:443":         "::1",
+		"sub.example.com.:": "sub.example.com",
+	} {
+		if got := normalizeHost(host); got != expected {
+			t.Errorf("%s: expected %s got %s", host, expected, got)
+		}
+	}
+}
+
+func TestCertificates_GetCertificate(t *testing.T) {
+	site, fallback, issued := &tls.Certificate{}, &tls.Certificate{}, &tls.Certificate{}
+	certs := &certificates{
+		byHost:    map[string]*tls.Certificate{"brand1.example": site},
+		fallback:  fallback,
+		acmeHosts: map[string]bool{"brand2.example": true},
+		acme: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return issued, nil
+		},
+	}
+	for host, expected := range map[string]*tls.Certificate{
+		"brand1.example": site,
+		"BRAND2.example": issued,
+		"other.example":  fallback,
+	} {
+		if got := must(certs.GetCertificate(&tls.ClientHelloInfo{ServerName: host})); got != expected {
+			t.Errorf("%s: unexpected certificate", host)
+		}
+	}
+	certs.fallback = nil
+	if _, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example"}); err == nil {
+		t.Error("expected no certificate")
+	}
+}
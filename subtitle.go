@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// srtSuffix marks the cache entry of a .vtt converted from its sibling .srt,
+// followed by the shift in milliseconds.
+const srtSuffix = ":srt"
+
+const maxSubtitleSize = 8 << 20
+
+func srtKey(vttPath string, shift int64) string {
+	return vttPath + srtSuffix + strconv.FormatInt(shift, 10)
+}
+
+// srtFetcher converts the .srt sibling of a .vtt requested under srtKey.
+func (s *Server) srtFetcher(next OnMissing) OnMissing {
+	return func(ctx context.Context, key, etag string) (object, error) {
+		i := strings.LastIndex(key, srtSuffix)
+		if i < 0 || !strings.HasSuffix(key[:i], ".vtt") {
+			return next(ctx, key, etag)
+		}
+		shift, err := strconv.ParseInt(key[i+len(srtSuffix):], 10, 64)
+		if err != nil {
+			return next(ctx, key, etag)
+		}
+		res, content, err := s.content(ctx, ctx, strings.TrimSuffix(key[:i], ".vtt")+".srt")
+		if err != nil || content == nil {
+			return object{}, err
+		}
+		defer res.Close()
+		if etag != "" && etag == res.meta.etag {
+			return object{ETag: etag}, errNotModified
+		}
+		srt, err := io.ReadAll(io.LimitReader(content, maxSubtitleSize+1))
+		if err != nil {
+			return object{}, err
+		}
+		if len(srt) > maxSubtitleSize {
+			return object{}, errors.New("subtitle too large")
+		}
+		return object{Value: srtToVTT(srt, time.Duration(shift)*time.Millisecond), ETag: res.meta.etag}, nil
+	}
+}
+
+// windows1252 maps 0x80-0x9f, the rest of the code page matches Latin-1.
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+// toUTF8 detects UTF-8 and UTF-16 by their BOM or validity, anything else is
+// read as Windows-1252.
+func toUTF8(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xef, 0xbb, 0xbf}):
+		return string(b[3:])
+	case bytes.HasPrefix(b, []byte{0xff, 0xfe}), bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		bigEndian := b[0] == 0xfe
+		units := make([]uint16, 0, len(b)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			if bigEndian {
+				units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+			} else {
+				units = append(units, uint16(b[i+1])<<8|uint16(b[i]))
+			}
+		}
+		return string(utf16.Decode(units))
+	case utf8.Valid(b):
+		return string(b)
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		if c >= 0x80 && c < 0xa0 {
+			runes[i] = windows1252[c-0x80]
+		} else {
+			runes[i] = rune(c)
+		}
+	}
+	return string(runes)
+}
+
+var (
+	srtTiming = regexp.MustCompile(`^\s*(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})\s*-->\s*(\d+):(\d{1,2}):(\d{1,2})[,.](\d{1,3})`)
+	srtFont   = regexp.MustCompile(`(?i)</?font[^>]*>`)
+)
+
+func parseSRTTime(parts []string) time.Duration {
+	var v [4]int64
+	for i, part := range parts {
+		v[i], _ = strconv.ParseInt(part, 10, 64)
+	}
+	//"1,5" means 500ms
+	for n := len(parts[3]); n < 3; n++ {
+		v[3] *= 10
+	}
+	return time.Duration(v[0])*time.Hour + time.Duration(v[1])*time.Minute + time.Duration(v[2])*time.Second + time.Duration(v[3])*time.Millisecond
+}
+
+func formatVTTTime(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return pad(ms/3600000, 2) + ":" + pad(ms/60000%60, 2) + ":" + pad(ms/1000%60, 2) + "." + pad(ms%1000, 3)
+}
+
+func pad(v int64, width int) string {
+	s := strconv.FormatInt(v, 10)
+	for len(s) < width {
+		s = "0" + s
+	}
+	return s
+}
+
+// srtToVTT converts cues, shifting them by shift. Cues shifted to end before
+// zero are dropped.
+func srtToVTT(srt []byte, shift time.Duration) []byte {
+	text := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(toUTF8(srt))
+	out := &strings.Builder{}
+	out.WriteString("WEBVTT\n")
+	for _, block := range strings.Split(text, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		for len(lines) > 0 && srtTiming.FindStringSubmatch(lines[0]) == nil {
+			lines = lines[1:]
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		m := srtTiming.FindStringSubmatch(lines[0])
+		start, end := parseSRTTime(m[1:5])+shift, parseSRTTime(m[5:9])+shift
+		if end <= 0 {
+			continue
+		}
+		out.WriteString("\n" + formatVTTTime(start) + " --> " + formatVTTTime(end) + "\n")
+		for _, line := range lines[1:] {
+			line = strings.ReplaceAll(srtFont.ReplaceAllString(line, ""), "-->", "->")
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			out.WriteString(line + "\n")
+		}
+	}
+	return []byte(out.String())
+}
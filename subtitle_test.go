@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSRTToVTT(t *testing.T) {
+	srt := "1\r\n00:00:01,500 --> 00:00:03,000\r\n<font color=\"red\">Caf\xe9</font>\r\n\r\n2\r\n00:00:00,100 --> 00:00:00,400\r\ngone\r\n\r\n3\r\n01:02:03,4 --> 01:02:05,000 X1:0\r\n\x93a\x94 --> b\r\n"
+	expected := "WEBVTT\n\n00:00:00.500 --> 00:00:02.000\nCafé\n\n01:02:02.400 --> 01:02:04.000\n“a” -> b\n"
+	if got := string(srtToVTT([]byte(srt), -time.Second)); got != expected {
+		t.Fatalf("unexpected %q", got)
+	}
+	utf16le := []byte{0xff, 0xfe, '1', 0, '\n', 0, 0xe9, 0}
+	assert(toUTF8(utf16le) == "1\né")
+	assert(toUTF8([]byte("\xef\xbb\xbfé")) == "é")
+}
+
+func TestServer_SRTFallback(t *testing.T) {
+	s := &Server{}
+	dbPath := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	hits := 0
+	s.cache = Open(dbPath, 1e+6, s.srtFetcher(func(ctx context.Context, key, etag string) (object, error) {
+		hits++
+		if key == "/a/b.srt" {
+			return object{Value: []byte("1\n00:00:01,000 --> 00:00:02,000\nhi\n"), ETag: `"1"`}, nil
+		}
+		return object{}, nil
+	}))
+	defer func() { _ = s.cache.Close() }()
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/a/b.vtt?shift=2000", nil))
+		assert(recorder.Code == http.StatusOK)
+		assert(string(must(io.ReadAll(recorder.Body))) == "WEBVTT\n\n00:00:03.000 --> 00:00:04.000\nhi\n")
+	}
+	//the .vtt is looked up again, the .srt and its conversion are cached
+	assert(hits == 3)
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/a/c.vtt", nil))
+	assert(recorder.Code == http.StatusNotFound)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// serveZip streams a store-only archive of the objects directly in dir, like
+// a token signed for dir authorizes, fetching each through the cache as it is
+// written. Errors after the archive started abort the response since its
+// status is already sent. The write deadline is extended before each entry
+// and write, archives outlast the write timeout.
+func (s *Server) serveZip(writer http.ResponseWriter, request *http.Request, streamCtx context.Context, dir string, claims url.Values) {
+	header, err := disposition(claims)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if header == "" {
+		header = contentDisposition("attachment", path.Base(dir)+".zip")
+	}
+	entries, err := s.origin.List(request.Context(), dir, false)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	files := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name, "/") {
+			files = append(files, entry)
+		}
+	}
+	if len(files) == 0 {
+		http.NotFound(writer, request)
+		return
+	}
+	stream := &streamWriter{ResponseWriter: writer, timeout: s.writeTimeout}
+	stream.Header().Set("Content-Type", "application/zip")
+	stream.Header().Set("Content-Disposition", header)
+	archive := zip.NewWriter(stream)
+	for _, entry := range files {
+		//fetching an entry may take long before its first write
+		extendDeadline(writer, s.writeTimeout)
+		if err := s.zipEntry(streamCtx, archive, dir, entry); err != nil {
+			metrics.Add("zip.failed", 1)
+			stream.abort(err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		metrics.Add("zip.failed", 1)
+		stream.abort(err)
+		return
+	}
+	metrics.Add("zip.served", 1)
+}
+
+func (s *Server) zipEntry(streamCtx context.Context, archive *zip.Writer, dir string, entry listEntry) error {
+	ctx, cancel := context.WithTimeout(streamCtx, time.Second*10)
+	defer cancel()
+	res, content, err := s.content(ctx, streamCtx, dir+"/"+entry.Name)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	//listed objects deleted since are left out
+	if content == nil {
+		return nil
+	}
+	w, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     entry.Name,
+		Method:   zip.Store,
+		Modified: entry.Modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func writeFiles(root string, files map[string]string) {
+	for name, content := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		throw(os.MkdirAll(filepath.Dir(name), 0700))
+		throw(os.WriteFile(name, []byte(content), 0600))
+	}
+}
+
+func TestOrigin_List(t *testing.T) {
+	root := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	defer func() { _ = os.RemoveAll(root) }()
+	writeFiles(filepath.Join(root, "1"), map[string]string{"s1/a.mp4": "1", "s1/subs/en.vtt": "1", "s1/.hidden.txt": "1"})
+	writeFiles(filepath.Join(root, "2"), map[string]string{"s1/a.mp4": "22", "s1/b.mp4": "22"})
+	origin := &Origin{backends: []Backend{
+		must(newDirBackend(&Source{Root: filepath.Join(root, "1")})),
+		must(newHTTPBackend(&Source{Host: "http://127.0.0.1:1"})),
+		must(newDirBackend(&Source{Root: filepath.Join(root, "2")})),
+	}}
+	entries := must(origin.List(context.Background(), "/s1", false))
+	if len(entries) != 3 || entries[0].Name != "a.mp4" || entries[0].Size != 1 || entries[1].Name != "b.mp4" || entries[2].Name != "subs/" {
+		t.Fatalf("unexpected %+v", entries)
+	}
+	entries = must(origin.List(context.Background(), "/s1", true))
+	assert(len(entries) == 3 && entries[2].Name == "subs/en.vtt")
+	assert(len(must(origin.List(context.Background(), "/missing", true))) == 0)
+}
+
+func TestServer_Zip(t *testing.T) {
+	root := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	defer func() { _ = os.RemoveAll(root) }()
+	files := map[string]string{"season/e1.mp4": "episode 1", "season/subs/e1.vtt": "WEBVTT\n"}
+	writeFiles(root, files)
+	public, key := must2(ed25519.GenerateKey(rand.Reader))
+	origin := &Origin{backends: []Backend{must(newDirBackend(&Source{Root: root}))}}
+	s := &Server{publicKeys: []ed25519.PublicKey{public}, origin: origin}
+	disk := Open(filepath.Join(root, "cache"), 1e+6, origin.Download)
+	defer func() { _ = disk.Close() }()
+	s.cache = disk
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/"+genAuth("season", time.Now().Add(time.Minute), key)+".zip", nil))
+	assert(recorder.Code == http.StatusOK)
+	assert(recorder.Header().Get("Content-Disposition") == `attachment; filename="season.zip"; filename*=UTF-8''season.zip`)
+	body := recorder.Body.Bytes()
+	archive := must(zip.NewReader(bytes.NewReader(body), int64(len(body))))
+	//the token authorizes no sub directory
+	assert(len(archive.File) == 1 && archive.File[0].Name == "e1.mp4")
+	for _, file := range archive.File {
+		assert(file.Method == zip.Store)
+		assert(string(must(io.ReadAll(must(file.Open())))) == files["season/"+file.Name])
+	}
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/"+genAuth("other", time.Now().Add(time.Minute), key)+".zip", nil))
+	assert(recorder.Code == http.StatusNotFound)
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/"+genAuth("season/subs", time.Now().Add(time.Minute), key)+".zip", nil))
+	assert(recorder.Code == http.StatusOK)
+
+	s.cache = OnMissing(func(ctx context.Context, key, etag string) (object, error) {
+		return object{}, errors.New("origin down")
+	})
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/"+genAuth("season", time.Now().Add(time.Minute), key)+".zip", nil))
+	assert(recorder.Code == http.StatusInternalServerError && recorder.Header().Get("Content-Disposition") == "")
+	recorder = httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/"+genAuth("", time.Now().Add(time.Minute), key)+"/season.zip", nil))
+	assert(recorder.Code == http.StatusUnauthorized)
+}
+
+func TestServer_ZipWriteTimeout(t *testing.T) {
+	root := filepath.Join(os.TempDir(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	defer func() { _ = os.RemoveAll(root) }()
+	files := map[string]string{}
+	for i := 0; i < 4; i++ {
+		files["season/e"+strconv.Itoa(i)+".mp4"] = string(make([]byte, 64<<10))
+	}
+	writeFiles(root, files)
+	public, key := must2(ed25519.GenerateKey(rand.Reader))
+	origin := &Origin{backends: []Backend{must(newDirBackend(&Source{Root: root}))}}
+	s := &Server{publicKeys: []ed25519.PublicKey{public}, origin: origin, writeTimeout: 200 * time.Millisecond}
+	//each entry takes long to fetch, the archive outlasts the write timeout
+	s.cache = OnMissing(func(ctx context.Context, key, etag string) (object, error) {
+		time.Sleep(100 * time.Millisecond)
+		return origin.Download(ctx, key, etag)
+	})
+	server := httptest.NewUnstartedServer(s)
+	server.Config.WriteTimeout = s.writeTimeout
+	server.Start()
+	defer server.Close()
+	response := must(http.Get(server.URL + "/" + genAuth("season", time.Now().Add(time.Minute), key) + ".zip"))
+	defer func() { _ = response.Body.Close() }()
+	body := must(io.ReadAll(response.Body))
+	archive := must(zip.NewReader(bytes.NewReader(body), int64(len(body))))
+	assert(len(archive.File) == 4)
+}